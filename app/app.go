@@ -4,8 +4,10 @@ import (
 	"context"
 	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -13,24 +15,57 @@ import (
 	"github.com/wavemechanics/qdeliver/deliver"
 	"github.com/wavemechanics/qdeliver/lookup"
 	"github.com/wavemechanics/qdeliver/notify"
-	"github.com/wavemechanics/qdeliver/store/webdav"
+	"github.com/wavemechanics/qdeliver/sign"
+	"github.com/wavemechanics/qdeliver/store"
+	"github.com/wavemechanics/qdeliver/store/cache"
+	"github.com/wavemechanics/qdeliver/store/fallback"
+	"github.com/wavemechanics/qdeliver/store/signed"
 	"github.com/wavemechanics/qdeliver/users"
+
+	// storage backends, registered by URL scheme
+	_ "github.com/wavemechanics/qdeliver/store/fs"
+	_ "github.com/wavemechanics/qdeliver/store/git"
+	_ "github.com/wavemechanics/qdeliver/store/mem"
+	_ "github.com/wavemechanics/qdeliver/store/webdav"
 )
 
+// commands are the admin commands run by Run when it is given --admin.
+// Each is given the arguments following its name.
+//
+var commands = map[string]func(args []string) int{
+	"explain": Explain,
+	"history": History,
+	"lint":    Lint,
+	"sign":    Sign,
+	"users":   Users,
+}
+
 // Run is a more testable main
 //
 func Run(args []string) int {
+	var admin bool
 	var dbpath string
 	var handler string
 	var notifyscript string
+	var cachedir string
 
 	flags := flag.NewFlagSet("main", flag.ContinueOnError)
-	flags.StringVar(&dbpath, "db", "users.json", "path to user database")
+	flags.StringVar(&dbpath, "db", "users.json", "path to user database, JSON or cdb")
 	flags.StringVar(&handler, "handler", "./qdeliver-handler.sh", "delivery handler script")
 	flags.StringVar(&notifyscript, "notify", "./qdeliver-notify.sh", "new address notification script")
+	flags.StringVar(&cachedir, "cache", "", "directory for copies of address files to use when storage is unavailable")
+	flags.BoolVar(&admin, "admin", false, "run one of the commands below instead of delivering mail")
 
 	u := usage{
 		Flags: flags,
+		Synopsis: []string{
+			"[options] localpart domain",
+			"--admin explain [options] localpart domain",
+			"--admin history [options] localpart domain",
+			"--admin lint [options] [owner domain]",
+			"--admin sign [options] file...",
+			"--admin users add|remove|list|set|compile|migrate ...",
+		},
 	}
 	flags.Usage = u.Usage
 
@@ -38,6 +73,15 @@ func Run(args []string) int {
 		log.Println(err)
 		return 2
 	}
+	// Commands need a flag, so mail to an owner named after one of
+	// them is still delivered.
+	if admin {
+		if command, ok := commands[flags.Arg(0)]; ok {
+			return command(flags.Args()[1:])
+		}
+		flags.Usage()
+		return 2
+	}
 	if flags.NArg() != 2 {
 		flags.Usage()
 		return 2
@@ -47,19 +91,18 @@ func Run(args []string) int {
 		return 2
 	}
 
-	localpart := strings.ToLower(flags.Arg(0))
-	domain := flags.Arg(1)
-	owner := strings.Split(localpart, "-")[0]
-	if owner == "" || localpart == "" || domain == "" {
+	localpart, owner, domain, ok := address(flags.Arg(0), flags.Arg(1))
+	if !ok {
 		flags.Usage()
 		return 2
 	}
 
-	db, err := users.Load(dbpath)
+	db, err := users.Open(dbpath)
 	if err != nil {
 		log.Println(err)
 		return 1
 	}
+	defer db.Close()
 
 	account, err := db.Lookup(owner, domain)
 	if err != nil {
@@ -70,19 +113,35 @@ func Run(args []string) int {
 		return 1
 	}
 
-	storage, err := webdav.New(account.URL, account.Login, account.Password)
+	storage, err := open(account)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	if cachedir != "" {
+		storage, err = withCache(cachedir, account, storage)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+	files, err := verified(account, storage)
 	if err != nil {
 		log.Println(err)
 		return 1
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout(account))
 	defer cancel()
 
-	instructions, created, err := lookup.Lookup(ctx, storage, localpart)
+	instructions, created, err := lookup.Lookup(ctx, files, localpart)
 	if errors.Is(err, os.ErrNotExist) {
 		log.Printf("%s@%s: localpart not found, and no default\n", localpart, domain)
 		return 100 // permanent; address file doesn't exist
 	}
+	if errors.Is(err, sign.ErrUnsigned) || errors.Is(err, sign.ErrBadSignature) {
+		log.Printf("%s@%s: refusing address file: %v", localpart, domain, err)
+		return 1 // temporary; the owner can sign the file
+	}
 	if err != nil {
 		log.Println(err)
 		return 1
@@ -92,7 +151,7 @@ func Run(args []string) int {
 	var status int
 	wg.Add(1)
 	go func() {
-		status = deliver.Deliver(ctx, &wg, handler, instructions)
+		status = deliver.Deliver(ctx, &wg, handler, storage, localpart, instructions)
 	}()
 	if created && account.Notify {
 		wg.Add(1)
@@ -102,3 +161,109 @@ func Run(args []string) int {
 
 	return status
 }
+
+// defaultTimeout limits how long handling mail for an address may take,
+// unless the account sets its own timeout.
+//
+const defaultTimeout = 10 * time.Second
+
+// timeout returns how long handling mail for account may take.
+//
+func timeout(account *users.Account) time.Duration {
+	if account.Timeout > 0 {
+		return time.Duration(account.Timeout)
+	}
+	return defaultTimeout
+}
+
+// address lower-cases localpart and extracts the owner from it.
+// ok is false if any part of the address is missing.
+//
+func address(local, domain string) (localpart, owner, dom string, ok bool) {
+	localpart = strings.ToLower(local)
+	owner = strings.Split(localpart, "-")[0]
+	if owner == "" || localpart == "" || domain == "" {
+		return "", "", "", false
+	}
+	return localpart, owner, domain, true
+}
+
+// open returns the storage holding account's address files. If the account
+// has fallback URLs, they are opened with the same credentials and tried
+// in order after the primary URL.
+//
+func open(account *users.Account) (store.Storage, error) {
+	options, err := storeOptions(account)
+	if err != nil {
+		return nil, err
+	}
+	primary, err := store.Open(account.URL, options)
+	if err != nil || len(account.Fallbacks) == 0 {
+		return primary, err
+	}
+
+	backends := []store.Storage{primary}
+	for _, u := range account.Fallbacks {
+		s, err := store.Open(u, options)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, s)
+	}
+	return fallback.New(backends, account.Replicate), nil
+}
+
+// storeOptions returns the settings of account that storage backends use.
+//
+func storeOptions(account *users.Account) (store.Options, error) {
+	l, err := account.FileLayout()
+	if err != nil {
+		return store.Options{}, err
+	}
+	options := store.Options{
+		Owner:    account.Owner,
+		Domain:   account.Domain,
+		Login:    account.Login,
+		Password: account.Password,
+		Layout:   l,
+	}
+	if r := account.Retry; r != nil {
+		options.Retry = &store.Retry{
+			Attempts:   r.Attempts,
+			Backoff:    time.Duration(r.Backoff),
+			MaxBackoff: time.Duration(r.MaxBackoff),
+		}
+	}
+	if a := account.Auth; a != nil {
+		options.Auth = &store.Auth{Mode: a.Mode, Cert: a.Cert, Key: a.Key}
+	}
+	if t := account.TLS; t != nil {
+		options.TLS = &store.TLS{CA: t.CA, Pin: t.Pin, MinVersion: t.MinVersion}
+	}
+	return options, nil
+}
+
+// verified wraps storage so that only address files signed with account's
+// public key can be read from it. If account has no public key, storage is
+// returned as it is.
+//
+func verified(account *users.Account, storage store.Storage) (store.Storage, error) {
+	if account.PublicKey == "" {
+		return storage, nil
+	}
+	key, err := sign.ParsePublicKey(account.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%s@%s: public_key: %w", account.Owner, account.Domain, err)
+	}
+	return signed.New(storage, key), nil
+}
+
+// withCache wraps storage in a cache kept in account's own subdirectory of dir.
+//
+func withCache(dir string, account *users.Account, storage store.Storage) (store.Storage, error) {
+	c, err := cache.New(filepath.Join(dir, account.Owner+"@"+account.Domain), storage)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -1,15 +1,24 @@
 package app_test
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/wavemechanics/qdeliver/app"
 	"github.com/wavemechanics/qdeliver/internal/webdavd"
+	"github.com/wavemechanics/qdeliver/store/mem"
 	"github.com/wavemechanics/qdeliver/users"
 )
 
@@ -23,6 +32,8 @@ func TestFlags(t *testing.T) {
 		{[]string{"local"}, 2},
 		{[]string{"-z"}, 2},
 		{[]string{"", ""}, 2},
+		{[]string{"--admin"}, 2},
+		{[]string{"--admin", "nosuchcommand"}, 2},
 	}
 
 	for _, test := range tests {
@@ -258,3 +269,1382 @@ func TestInstructions(t *testing.T) {
 		t.Fatalf("notify output: %q, want %q", notifyMsg, want)
 	}
 }
+
+// TestExplain tests that explain reports without delivering or creating anything
+func TestExplain(t *testing.T) {
+	owner := "owner"
+	domain := "example.com"
+
+	dir, err := ioutil.TempDir("", "TestExplain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := webdavd.Server{
+		Dir:  dir,
+		User: "hello",
+		Pass: "letmein",
+	}
+
+	shutdown := server.Start()
+	defer shutdown()
+
+	udata := &users.Users{
+		Version: 1,
+		Accounts: []users.Account{
+			{
+				Owner:    owner,
+				Domain:   domain,
+				URL:      server.Addr,
+				Login:    server.User,
+				Password: server.Pass,
+				Notify:   true,
+			},
+		},
+	}
+
+	dbpath := filepath.Join(dir, "users.json")
+	if err = udata.Save(dbpath); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"owner.txt":     "forward me@example.com\n",
+		"owner-bad.txt": "forward 'me@example.com\n",
+		"default.txt":   "# new address\nmatch-subject 'code word'\nsh -c true\nforward me@example.com\n",
+	}
+	for name, contents := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		localpart string
+		exit      int
+		output    []string
+	}{
+		{"stranger", 100, []string{"not in"}},
+		{owner, 0, []string{"file:     owner.txt\n", `forward "me@example.com"`}},
+		{owner + "-bad", 1, []string{"1:9: unterminated single quote"}},
+		{owner + "-new", 0, []string{
+			"owner-new.txt would be created from default.txt",
+			"owner@example.com would be told",
+			`2:1	match-subject "code word"`,
+			"3:1	sh \"-c\" \"true\"	(passed to handler)",
+		}},
+	}
+
+	for _, test := range tests {
+		var exit int
+		output := capture(t, func() {
+			exit = app.Run([]string{"--admin", "explain", "--db", dbpath, test.localpart, domain})
+		})
+		if exit != test.exit {
+			t.Errorf("%s: exit %d, want %d", test.localpart, exit, test.exit)
+		}
+		for _, want := range test.output {
+			if !strings.Contains(output, want) {
+				t.Errorf("%s: output %q does not contain %q", test.localpart, output, want)
+			}
+		}
+		if strings.Contains(output, server.Pass) {
+			t.Errorf("%s: output %q shows the password", test.localpart, output)
+		}
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, owner+"-new.txt")); !os.IsNotExist(err) {
+		t.Fatalf("explain created %s-new.txt: %v", owner, err)
+	}
+}
+
+// capture returns whatever f writes to stdout.
+func capture(t *testing.T, f func()) string {
+	tmp, err := ioutil.TempFile("", "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	stdout := os.Stdout
+	os.Stdout = tmp
+	f()
+	os.Stdout = stdout
+
+	output, err := ioutil.ReadFile(tmp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(output)
+}
+
+// feed runs f with input as its stdin.
+func feed(t *testing.T, input string, f func()) {
+	tmp, err := ioutil.TempFile("", "stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err = tmp.WriteString(input); err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdin := os.Stdin
+	os.Stdin = tmp
+	f()
+	os.Stdin = stdin
+}
+
+// TestLint tests that lint reports problems in address files
+func TestLint(t *testing.T) {
+	domain := "example.com"
+
+	dir, err := ioutil.TempDir("", "TestLint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := webdavd.Server{
+		Dir:  dir,
+		User: "hello",
+		Pass: "letmein",
+	}
+
+	shutdown := server.Start()
+	defer shutdown()
+
+	for _, sub := range []string{"bad", "good"} {
+		if err = os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := map[string]string{
+		"bad/bad.txt":          "forward me@example.com\n",
+		"bad/bad-quote.txt":    "drop\nbounce 'gone\n",
+		"bad/bad-typo.txt":     "# comment\n  frwd me@example.com\n",
+		"bad/bad-empty.txt":    "# nothing here\n",
+		"bad/bad-custom.txt":   "spamcheck\n",
+		"good/good.txt":        "forward me@example.com\n",
+		"good/good-custom.txt": "spamcheck\nforward me@example.com\n",
+		"good/good-quiet.txt":  "# accepted and discarded\n",
+		"bad/bad-later.txt":    "expires +30d\ndrop\n",
+		"good/default.txt":     "expires +30d\ndrop\n",
+		"good/good.limit.txt":  `{"start":"2026-10-18T00:00:00Z","count":1}`,
+	}
+	for name, contents := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	udata := &users.Users{
+		Version: 1,
+		Accounts: []users.Account{
+			{
+				Owner:    "bad",
+				Domain:   domain,
+				URL:      server.Addr + "/bad",
+				Login:    server.User,
+				Password: server.Pass,
+			},
+			{
+				Owner:    "good",
+				Domain:   domain,
+				URL:      server.Addr + "/good",
+				Login:    server.User,
+				Password: server.Pass,
+			},
+		},
+	}
+
+	dbpath := filepath.Join(dir, "users.json")
+	if err = udata.Save(dbpath); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		args   []string
+		exit   int
+		output []string
+	}{
+		{[]string{"--allow", "spamcheck", "good", domain}, 0, []string{
+			"good@example.com: good-quiet.txt: warning: no instructions",
+		}},
+		{[]string{"--allow", "spamcheck,", "good", domain}, 0, []string{
+			"good@example.com: good-quiet.txt: warning: no instructions",
+		}},
+		{[]string{"good", domain}, 1, []string{
+			"good@example.com: good-custom.txt:1:1: unknown keyword \"spamcheck\"\n",
+		}},
+		{[]string{"--allow", "spamcheck"}, 1, []string{
+			"bad@example.com: bad-quote.txt:2:8: unterminated single quote\n",
+			"bad@example.com: bad-typo.txt:2:3: unknown keyword \"frwd\"\n",
+			"bad@example.com: bad-empty.txt: warning: no instructions",
+			"bad@example.com: default.txt: warning: missing",
+			"bad@example.com: bad-later.txt:1:1: relative date",
+		}},
+		{[]string{"bad", domain}, 1, []string{
+			"bad@example.com: bad-custom.txt:1:1: unknown keyword \"spamcheck\"\n",
+		}},
+		{[]string{"nobody", domain}, 1, nil},
+		{[]string{"one"}, 2, nil},
+	}
+
+	for _, test := range tests {
+		var exit int
+		output := capture(t, func() {
+			exit = app.Run(append([]string{"--admin", "lint", "--db", dbpath}, test.args...))
+		})
+		if exit != test.exit {
+			t.Errorf("%v: exit %d, want %d", test.args, exit, test.exit)
+		}
+		if test.output == nil && output != "" {
+			t.Errorf("%v: unexpected output %q", test.args, output)
+		}
+		for _, want := range test.output {
+			if !strings.Contains(output, want) {
+				t.Errorf("%v: output %q does not contain %q", test.args, output, want)
+			}
+		}
+	}
+}
+
+// TestCache tests that cached address files are used when webdav is down
+func TestCache(t *testing.T) {
+	owner := "owner"
+	domain := "example.com"
+
+	dir, err := ioutil.TempDir("", "TestCache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := webdavd.Server{
+		Dir:  dir,
+		User: "hello",
+		Pass: "letmein",
+	}
+	shutdown := server.Start()
+
+	udata := &users.Users{
+		Version: 1,
+		Accounts: []users.Account{
+			{
+				Owner:    owner,
+				Domain:   domain,
+				URL:      server.Addr,
+				Login:    server.User,
+				Password: server.Pass,
+			},
+		},
+	}
+
+	dbpath := filepath.Join(dir, "users.json")
+	if err = udata.Save(dbpath); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, owner+".txt"), []byte(`sh -c "exit 0"`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := []string{
+		"--db", dbpath,
+		"--handler", "testdata/handler.sh",
+		"--cache", filepath.Join(dir, "cache"),
+		owner, domain,
+	}
+
+	if exit := app.Run(args); exit != 0 {
+		t.Fatalf("server up: exit %d, want 0", exit)
+	}
+	shutdown()
+	if exit := app.Run(args); exit != 0 {
+		t.Fatalf("server down: exit %d, want 0", exit)
+	}
+	nocache := append(args[:4:4], owner, domain)
+	if exit := app.Run(nocache); exit != 1 {
+		t.Fatalf("server down, no cache: exit %d, want 1", exit)
+	}
+}
+
+// TestTimeout tests that an account's own timeout is used
+func TestTimeout(t *testing.T) {
+	owner := "owner"
+	domain := "example.com"
+
+	dir, err := ioutil.TempDir("", "TestTimeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := webdavd.Server{
+		Dir:  dir,
+		User: "hello",
+		Pass: "letmein",
+	}
+	shutdown := server.Start()
+	defer shutdown()
+
+	udata := &users.Users{
+		Version: 1,
+		Accounts: []users.Account{
+			{
+				Owner:    owner,
+				Domain:   domain,
+				URL:      server.Addr,
+				Login:    server.User,
+				Password: server.Pass,
+				Timeout:  users.Duration(time.Second),
+				Retry:    &users.Retry{Attempts: 2},
+			},
+		},
+	}
+
+	dbpath := filepath.Join(dir, "users.json")
+	if err = udata.Save(dbpath); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, owner+".txt"), []byte(`sh -c "sleep 5"`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	exit := app.Run([]string{"--db", dbpath, "--handler", "testdata/handler.sh", owner, domain})
+	if exit != 1 {
+		t.Fatalf("exit %d, want 1", exit)
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Fatalf("took %v; account timeout not used", elapsed)
+	}
+}
+
+// TestFileStorage tests accounts whose address files are in a local directory
+func TestFileStorage(t *testing.T) {
+	owner := "owner"
+	domain := "example.com"
+
+	dir, err := ioutil.TempDir("", "TestFileStorage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	udata := &users.Users{
+		Version: 1,
+		Accounts: []users.Account{
+			{
+				Owner:  owner,
+				Domain: domain,
+				URL:    "file://" + dir,
+			},
+		},
+	}
+
+	dbpath := filepath.Join(dir, "users.json")
+	if err = udata.Save(dbpath); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "default.txt"), []byte(`sh -c "exit 0"`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exit := app.Run([]string{"--db", dbpath, "--handler", "testdata/handler.sh", owner + "-new", domain})
+	if exit != 0 {
+		t.Fatalf("exit %d, want 0", exit)
+	}
+	if _, err = os.Stat(filepath.Join(dir, owner+"-new.txt")); err != nil {
+		t.Fatalf("address file not created: %v", err)
+	}
+}
+
+// TestSchemes tests that one user database can hold accounts with different
+// storage backends, and that an unknown scheme defers delivery.
+func TestSchemes(t *testing.T) {
+	domain := "example.com"
+
+	dir, err := ioutil.TempDir("", "TestSchemes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	udata := &users.Users{
+		Version: 1,
+		Accounts: []users.Account{
+			{Owner: "inmem", Domain: domain, URL: "mem://TestSchemes"},
+			{Owner: "ondisk", Domain: domain, URL: "file://" + dir},
+			{Owner: "unknown", Domain: domain, URL: "gopher://example.com/"},
+		},
+	}
+	dbpath := filepath.Join(dir, "users.json")
+	if err = udata.Save(dbpath); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err = mem.Named("TestSchemes").Set(ctx, "default", `sh -c "exit 0"`); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "default.txt"), []byte(`sh -c "exit 0"`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		local string
+		exit  int
+	}{
+		{"inmem-new", 0},
+		{"ondisk-new", 0},
+		{"unknown-new", 1},
+	}
+	for _, test := range tests {
+		exit := app.Run([]string{"--db", dbpath, "--handler", "testdata/handler.sh", test.local, domain})
+		if exit != test.exit {
+			t.Errorf("%s: exit %d, want %d", test.local, exit, test.exit)
+		}
+	}
+
+	if _, err = mem.Named("TestSchemes").Get(ctx, "inmem-new"); err != nil {
+		t.Errorf("mem: address file not created: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "ondisk-new.txt")); err != nil {
+		t.Errorf("file: address file not created: %v", err)
+	}
+}
+
+// TestFallback tests that address files are read from a fallback URL when
+// the primary server is down, but that new addresses are only created on
+// the primary.
+func TestFallback(t *testing.T) {
+	owner := "owner"
+	domain := "example.com"
+
+	dir, err := ioutil.TempDir("", "TestFallback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := webdavd.Server{
+		Dir:  dir,
+		User: "hello",
+		Pass: "letmein",
+	}
+	shutdown := server.Start()
+	shutdown() // the primary is down
+
+	mirror := filepath.Join(dir, "mirror")
+	if err = os.Mkdir(mirror, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{owner + ".txt", "default.txt"} {
+		err = ioutil.WriteFile(filepath.Join(mirror, name), []byte(`sh -c "exit 0"`), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	udata := &users.Users{
+		Version: 1,
+		Accounts: []users.Account{
+			{
+				Owner:     owner,
+				Domain:    domain,
+				URL:       server.Addr,
+				Fallbacks: []string{"file://" + mirror},
+				Login:     server.User,
+				Password:  server.Pass,
+			},
+		},
+	}
+	dbpath := filepath.Join(dir, "users.json")
+	if err = udata.Save(dbpath); err != nil {
+		t.Fatal(err)
+	}
+
+	exit := app.Run([]string{"--db", dbpath, "--handler", "testdata/handler.sh", owner, domain})
+	if exit != 0 {
+		t.Fatalf("existing address: exit %d, want 0", exit)
+	}
+
+	exit = app.Run([]string{"--db", dbpath, "--handler", "testdata/handler.sh", owner + "-new", domain})
+	if exit != 1 {
+		t.Fatalf("new address: exit %d, want 1", exit)
+	}
+	if _, err = os.Stat(filepath.Join(mirror, owner+"-new.txt")); !os.IsNotExist(err) {
+		t.Fatalf("new address created on the fallback: %v", err)
+	}
+}
+
+// TestAuthMode tests that the auth settings in the user database are used.
+func TestAuthMode(t *testing.T) {
+	owner := "owner"
+	domain := "example.com"
+
+	dir, err := ioutil.TempDir("", "TestAuthMode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := webdavd.Server{
+		Dir:  dir,
+		User: "hello",
+		Pass: "app-token",
+		Auth: "bearer",
+	}
+	shutdown := server.Start()
+	defer shutdown()
+
+	err = ioutil.WriteFile(filepath.Join(dir, owner+".txt"), []byte(`sh -c "exit 0"`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		auth *users.Auth
+		exit int
+	}{
+		{&users.Auth{Mode: "bearer"}, 0},
+		{nil, 1}, // basic
+		{&users.Auth{Mode: "digest"}, 1},
+		{&users.Auth{Mode: "kerberos"}, 1},
+		{&users.Auth{Mode: "cert"}, 1}, // no certificate
+	}
+	for _, test := range tests {
+		udata := &users.Users{
+			Version: 1,
+			Accounts: []users.Account{
+				{
+					Owner:    owner,
+					Domain:   domain,
+					URL:      server.Addr,
+					Login:    server.User,
+					Password: server.Pass,
+					Auth:     test.auth,
+				},
+			},
+		}
+		dbpath := filepath.Join(dir, "users.json")
+		if err = udata.Save(dbpath); err != nil {
+			t.Fatal(err)
+		}
+
+		exit := app.Run([]string{"--db", dbpath, "--handler", "testdata/handler.sh", owner, domain})
+		if exit != test.exit {
+			t.Errorf("%+v: exit %d, want %d", test.auth, exit, test.exit)
+		}
+	}
+}
+
+// TestTLSSettings tests that the tls settings in the user database are used.
+func TestTLSSettings(t *testing.T) {
+	owner := "owner"
+	domain := "example.com"
+
+	dir, err := ioutil.TempDir("", "TestTLSSettings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := webdavd.Server{
+		Dir:  dir,
+		User: "hello",
+		Pass: "letmein",
+		TLS:  true,
+	}
+	shutdown := server.Start()
+	defer shutdown()
+
+	err = ioutil.WriteFile(filepath.Join(dir, owner+".txt"), []byte(`sh -c "exit 0"`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := filepath.Join(dir, "ca.pem")
+	buf := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate.Raw})
+	if err = ioutil.WriteFile(ca, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(server.Certificate.RawSubjectPublicKeyInfo)
+	pin := "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+
+	var tests = []struct {
+		tls  *users.TLS
+		exit int
+	}{
+		{nil, 1}, // not trusted by the system
+		{&users.TLS{CA: ca}, 0},
+		{&users.TLS{CA: ca, Pin: pin, MinVersion: "1.2"}, 0},
+		{&users.TLS{CA: ca, Pin: "sha256/" + base64.StdEncoding.EncodeToString(make([]byte, 32))}, 1},
+		{&users.TLS{CA: ca, Pin: "not base64"}, 1},
+		{&users.TLS{CA: ca, MinVersion: "2.0"}, 1},
+		{&users.TLS{CA: filepath.Join(dir, owner+".txt")}, 1}, // no certificates
+	}
+	for _, test := range tests {
+		udata := &users.Users{
+			Version: 1,
+			Accounts: []users.Account{
+				{
+					Owner:    owner,
+					Domain:   domain,
+					URL:      server.Addr,
+					Login:    server.User,
+					Password: server.Pass,
+					TLS:      test.tls,
+				},
+			},
+		}
+		dbpath := filepath.Join(dir, "users.json")
+		if err = udata.Save(dbpath); err != nil {
+			t.Fatal(err)
+		}
+
+		exit := app.Run([]string{"--db", dbpath, "--handler", "testdata/handler.sh", owner, domain})
+		if exit != test.exit {
+			t.Errorf("%+v: exit %d, want %d", test.tls, exit, test.exit)
+		}
+	}
+}
+
+// TestLayoutSetting tests that the layout in the user database is used.
+func TestLayoutSetting(t *testing.T) {
+	owner := "owner"
+	domain := "example.com"
+
+	dir, err := ioutil.TempDir("", "TestLayoutSetting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ext := ".conf"
+	udata := &users.Users{
+		Version: 1,
+		Accounts: []users.Account{
+			{
+				Owner:  owner,
+				Domain: domain,
+				URL:    "file://" + dir,
+				Layout: &users.Layout{Extension: &ext, OwnerDir: true, Shard: 1},
+			},
+		},
+	}
+	dbpath := filepath.Join(dir, "users.json")
+	if err = udata.Save(dbpath); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Join(dir, owner, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, owner, "d", "default.conf"), []byte(`sh -c "exit 0"`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := capture(t, func() {
+		app.Run([]string{"--admin", "explain", "--db", dbpath, owner + "-new", domain})
+	})
+	if want := "owner/o/owner-new.conf would be created from owner/d/default.conf"; !strings.Contains(out, want) {
+		t.Errorf("explain: %q does not contain %q", out, want)
+	}
+
+	exit := app.Run([]string{"--db", dbpath, "--handler", "testdata/handler.sh", owner + "-new", domain})
+	if exit != 0 {
+		t.Fatalf("exit %d, want 0", exit)
+	}
+	if _, err = os.Stat(filepath.Join(dir, owner, "o", owner+"-new.conf")); err != nil {
+		t.Fatalf("address file not created: %v", err)
+	}
+}
+
+// TestSigned tests that accounts with a public key only use address files
+// signed by "qdeliver --admin sign", and defer mail for any others.
+func TestSigned(t *testing.T) {
+	owner := "owner"
+	domain := "example.com"
+
+	dir, err := ioutil.TempDir("", "TestSigned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyfile := filepath.Join(dir, "key")
+	pub := strings.TrimSpace(capture(t, func() {
+		if exit := app.Run([]string{"--admin", "sign", "--key", keyfile, "--generate"}); exit != 0 {
+			t.Fatalf("sign --generate: exit %d", exit)
+		}
+	}))
+	if info, err := os.Stat(keyfile); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("key file: %v, %v, want mode 0600", info.Mode(), err)
+	}
+	if exit := app.Run([]string{"--admin", "sign", "--key", keyfile, "--generate"}); exit != 1 {
+		t.Fatalf("sign --generate over an existing key: exit %d, want 1", exit)
+	}
+
+	udata := &users.Users{
+		Version: 1,
+		Accounts: []users.Account{
+			{
+				Owner:     owner,
+				Domain:    domain,
+				URL:       "file://" + dir,
+				PublicKey: pub,
+			},
+		},
+	}
+	dbpath := filepath.Join(dir, "users.json")
+	if err = udata.Save(dbpath); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"default.txt":      `sh -c "exit 0"`,
+		owner + ".txt":     `sh -c "exit 0"`,
+		owner + "-x.txt":   `sh -c "exit 0"`,
+		owner + "-bad.txt": `sh -c "exit 0"`,
+	}
+	for name, contents := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sign := func(args ...string) {
+		args = append([]string{"--admin", "sign", "--key", keyfile}, args...)
+		if exit := app.Run(args); exit != 0 {
+			t.Fatalf("%v: exit %d", args, exit)
+		}
+	}
+	sign("--sidecar", filepath.Join(dir, "default.txt"))
+	sign(filepath.Join(dir, owner+".txt"), filepath.Join(dir, owner+"-bad.txt"))
+
+	bad := filepath.Join(dir, owner+"-bad.txt")
+	buf, err := ioutil.ReadFile(bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := strings.Replace(string(buf), "exit 0", "exit 1", 1)
+	if err = ioutil.WriteFile(bad, []byte(tampered), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		localpart string
+		exit      int
+	}{
+		{owner, 0},
+		{owner + "-new", 0},
+		{owner + "-new", 0}, // copy of default, signed by its own sidecar
+		{owner + "-x", 1},
+		{owner + "-bad", 1},
+	}
+	for _, test := range tests {
+		exit := app.Run([]string{"--db", dbpath, "--handler", "testdata/handler.sh", test.localpart, domain})
+		if exit != test.exit {
+			t.Errorf("%s: exit %d, want %d", test.localpart, exit, test.exit)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(dir, owner+"-new.sig.txt")); err != nil {
+		t.Fatalf("signature of new address file not written: %v", err)
+	}
+
+	out := capture(t, func() {
+		app.Run([]string{"--admin", "lint", "--db", dbpath})
+	})
+	for _, want := range []string{owner + "-x.txt: " + owner + "-x: not signed", owner + "-bad.txt: " + owner + "-bad: signature does not match"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("lint: %q does not contain %q", out, want)
+		}
+	}
+	if strings.Contains(out, ".sig") {
+		t.Errorf("lint: %q checked a signature file", out)
+	}
+}
+
+// TestHistory tests that address files in a git: account have a history
+// that can be listed and rolled back.
+func TestHistory(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	owner := "owner"
+	domain := "example.com"
+
+	dir, err := ioutil.TempDir("", "TestHistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	udata := &users.Users{
+		Version: 1,
+		Accounts: []users.Account{
+			{
+				Owner:  owner,
+				Domain: domain,
+				URL:    "git://" + dir,
+			},
+		},
+	}
+	dbpath := filepath.Join(dir, "users.json")
+	if err = udata.Save(dbpath); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "default.txt"), []byte(`sh -c "exit 0"`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exit := app.Run([]string{"--db", dbpath, "--handler", "testdata/handler.sh", owner + "-new", domain})
+	if exit != 0 {
+		t.Fatalf("exit %d, want 0", exit)
+	}
+	file := filepath.Join(dir, owner+"-new.txt")
+	created, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(file, []byte("drop\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := capture(t, func() {
+		app.Run([]string{"--admin", "history", "--db", dbpath, owner + "-new", domain})
+	})
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], "owner <owner@example.com>  create owner-new.txt") {
+		t.Fatalf("history: %q", out)
+	}
+	commit := strings.Fields(lines[0])[0]
+
+	out = capture(t, func() {
+		app.Run([]string{"--admin", "history", "--db", dbpath, "--show", commit, owner + "-new", domain})
+	})
+	if out != string(created) {
+		t.Fatalf("history --show: %q, want %q", out, created)
+	}
+
+	if exit := app.Run([]string{"--admin", "history", "--db", dbpath, "--rollback", commit, owner + "-new", domain}); exit != 0 {
+		t.Fatalf("history --rollback: exit %d", exit)
+	}
+	if buf, _ := ioutil.ReadFile(file); string(buf) != string(created) {
+		t.Fatalf("after rollback: %q, want %q", buf, created)
+	}
+
+	if exit := app.Run([]string{"--admin", "history", "--db", dbpath, "--rollback", "nosuchcommit", owner + "-new", domain}); exit != 1 {
+		t.Fatalf("history --rollback of unknown commit: exit %d, want 1", exit)
+	}
+}
+
+// TestCompileUsers tests that a user database compiled to cdb can be used
+// TestHistorySigned tests that rolling back an address file of a signed
+// account also rolls back its sidecar signature
+func TestHistorySigned(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	owner := "owner"
+	domain := "example.com"
+
+	dir, err := ioutil.TempDir("", "TestHistorySigned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyfile := filepath.Join(dir, "key")
+	pub := strings.TrimSpace(capture(t, func() {
+		app.Run([]string{"--admin", "sign", "--key", keyfile, "--generate"})
+	}))
+	udata := &users.Users{
+		Version: users.Version,
+		Accounts: []users.Account{
+			{
+				Owner:     owner,
+				Domain:    domain,
+				URL:       "git://" + dir,
+				PublicKey: pub,
+			},
+		},
+	}
+	dbpath := filepath.Join(dir, "users.json")
+	if err = udata.Save(dbpath); err != nil {
+		t.Fatal(err)
+	}
+	sign := func(contents string) {
+		path := filepath.Join(dir, owner+".txt")
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if exit := app.Run([]string{"--admin", "sign", "--key", keyfile, "--sidecar", path}); exit != 0 {
+			t.Fatalf("sign: exit %d", exit)
+		}
+	}
+	deliver := func() int {
+		return app.Run([]string{"--db", dbpath, "--handler", "testdata/handler.sh", owner, domain})
+	}
+
+	// a delivery copying the default commits the file and its signature
+	sign(`sh -c "exit 0"`)
+	if err = os.Rename(filepath.Join(dir, owner+".txt"), filepath.Join(dir, "default.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(filepath.Join(dir, owner+".sig.txt"), filepath.Join(dir, "default.sig.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if exit := deliver(); exit != 0 {
+		t.Fatalf("first delivery: exit %d, want 0", exit)
+	}
+	out := capture(t, func() {
+		app.Run([]string{"--admin", "history", "--db", dbpath, owner, domain})
+	})
+	commit := strings.Fields(out + " x")[0]
+
+	sign(`sh -c "exit 100"`)
+	if exit := deliver(); exit != 100 {
+		t.Fatalf("delivery after signing a change: exit %d, want 100", exit)
+	}
+
+	if exit := app.Run([]string{"--admin", "history", "--db", dbpath, "--rollback", commit, owner, domain}); exit != 0 {
+		t.Fatalf("history --rollback: exit %d", exit)
+	}
+	if exit := deliver(); exit != 0 {
+		t.Fatalf("delivery after rollback: exit %d, want 0", exit)
+	}
+}
+
+// in place of the JSON one.
+func TestCompileUsers(t *testing.T) {
+	owner := "owner"
+	domain := "example.com"
+
+	dir, err := ioutil.TempDir("", "TestCompileUsers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	udata := &users.Users{
+		Version: 1,
+		Accounts: []users.Account{
+			{
+				Owner:  owner,
+				Domain: domain,
+				URL:    "file://" + dir,
+			},
+		},
+	}
+	jsonpath := filepath.Join(dir, "users.json")
+	if err = udata.Save(jsonpath); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, owner+".txt"), []byte(`sh -c "exit 0"`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exit := app.Run([]string{"--admin", "users", "compile", jsonpath}); exit != 2 {
+		t.Fatalf("users compile with one file: exit %d, want 2", exit)
+	}
+	dbpath := filepath.Join(dir, "users.cdb")
+	if exit := app.Run([]string{"--admin", "users", "compile", jsonpath, dbpath}); exit != 0 {
+		t.Fatalf("users compile: exit %d", exit)
+	}
+
+	var tests = []struct {
+		localpart string
+		exit      int
+	}{
+		{owner, 0},
+		{"nobody", 100},
+	}
+	for _, test := range tests {
+		exit := app.Run([]string{"--db", dbpath, "--handler", "testdata/handler.sh", test.localpart, domain})
+		if exit != test.exit {
+			t.Errorf("%s: exit %d, want %d", test.localpart, exit, test.exit)
+		}
+	}
+
+	out := capture(t, func() {
+		app.Run([]string{"--admin", "lint", "--db", dbpath})
+	})
+	if want := owner + "@" + domain + ": default.txt: warning"; !strings.Contains(out, want) {
+		t.Errorf("lint: %q does not contain %q", out, want)
+	}
+}
+
+// TestPasswordSources tests that passwords can be kept out of the user
+// database, and that a world-readable database with passwords in it is
+// refused.
+func TestPasswordSources(t *testing.T) {
+	owner := "owner"
+	domain := "example.com"
+
+	dir, err := ioutil.TempDir("", "TestPasswordSources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := webdavd.Server{
+		Dir:  dir,
+		User: "hello",
+		Pass: "s3cret-pass",
+	}
+	shutdown := server.Start()
+	defer shutdown()
+
+	err = ioutil.WriteFile(filepath.Join(dir, owner+".txt"), []byte(`sh -c "exit 0"`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passfile := filepath.Join(dir, "password")
+	if err = ioutil.WriteFile(passfile, []byte(server.Pass+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name    string
+		account users.Account
+		mode    os.FileMode
+		exit    int
+	}{
+		{"file", users.Account{PasswordFile: passfile}, 0644, 0},
+		{"command", users.Account{PasswordCommand: "cat " + passfile}, 0644, 0},
+		{"missing file", users.Account{PasswordFile: passfile + ".missing"}, 0644, 1},
+		{"inline", users.Account{Password: server.Pass}, 0600, 0},
+		{"inline, world-readable", users.Account{Password: server.Pass}, 0644, 1},
+	}
+	for _, test := range tests {
+		account := test.account
+		account.Owner = owner
+		account.Domain = domain
+		account.URL = server.Addr
+		account.Login = server.User
+		udata := &users.Users{Version: 1, Accounts: []users.Account{account}}
+
+		dbpath := filepath.Join(dir, "users.json")
+		if err = udata.Save(dbpath); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Chmod(dbpath, test.mode); err != nil {
+			t.Fatal(err)
+		}
+
+		exit := app.Run([]string{"--db", dbpath, "--handler", "testdata/handler.sh", owner, domain})
+		if exit != test.exit {
+			t.Errorf("%s: exit %d, want %d", test.name, exit, test.exit)
+		}
+	}
+
+	udata := &users.Users{Version: 1, Accounts: []users.Account{
+		{Owner: owner, Domain: domain, URL: server.Addr, PasswordFile: passfile},
+	}}
+	dbpath := filepath.Join(dir, "users.json")
+	if err = udata.Save(dbpath); err != nil {
+		t.Fatal(err)
+	}
+	out := capture(t, func() {
+		app.Run([]string{"--admin", "explain", "--db", dbpath, owner, domain})
+	})
+	if want := "password: (from file " + passfile + ")"; !strings.Contains(out, want) || strings.Contains(out, server.Pass) {
+		t.Errorf("explain: %q, want %q and not the password", out, want)
+	}
+}
+
+// TestUsersCommands tests editing the user database
+func TestUsersCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestUsersCommands")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"users.json", "users.cdb"} {
+		dbpath := filepath.Join(dir, name)
+		var tests = []struct {
+			args  []string
+			stdin string
+			exit  int
+		}{
+			{[]string{"add", "--db", dbpath, "owner", "example.com", "file://" + dir}, "", 0},
+			{[]string{"add", "--db", dbpath, "--password-env", "PASSWORD", "Other", "example.com", "file://" + dir}, "", 0},
+			{[]string{"add", "--db", dbpath, "owner", "example.com", "file:///elsewhere"}, "", 1},
+			{[]string{"add", "--db", dbpath, "owner", "example.com"}, "", 2},
+			{[]string{"set", "--db", dbpath, "owner", "example.com", "password=s3cret-pass"}, "", 2},
+			{[]string{"set", "--db", dbpath, "--password-stdin", "owner", "example.com", "timeout=30s", "notify=true", "login=joe"}, "s3cret-pass\n", 0},
+			{[]string{"set", "--db", dbpath, "owner", "example.com", "password_env=PASSWORD"}, "", 1},
+			{[]string{"set", "--db", dbpath, "owner", "example.com", "no_such_field=1"}, "", 1},
+			{[]string{"set", "--db", dbpath, "owner", "example.com", "timeout=soon"}, "", 1},
+			{[]string{"set", "--db", dbpath, "owner", "example.com", "url="}, "", 1},
+			{[]string{"set", "--db", dbpath, "nobody", "example.com", "notify=true"}, "", 1},
+			{[]string{"set", "--db", dbpath, "owner", "example.com"}, "", 2},
+			{[]string{"remove", "--db", dbpath, "nobody", "example.com"}, "", 1},
+			{[]string{"bogus"}, "", 2},
+		}
+		for _, test := range tests {
+			var exit int
+			feed(t, test.stdin, func() {
+				exit = app.Run(append([]string{"--admin", "users"}, test.args...))
+			})
+			if exit != test.exit {
+				t.Errorf("%s: users %s: exit %d, want %d", name, strings.Join(test.args, " "), exit, test.exit)
+			}
+		}
+
+		if isCDB, err := users.IsCDB(dbpath); err != nil || isCDB != (name == "users.cdb") {
+			t.Errorf("%s: IsCDB %v, %v", name, isCDB, err)
+		}
+		db, err := users.Load(dbpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(db.Accounts) != 2 {
+			t.Fatalf("%s: %d accounts, want 2", name, len(db.Accounts))
+		}
+		account := db.Accounts[0]
+		if account.Owner != "owner" {
+			account = db.Accounts[1]
+		}
+		if account.Password != "s3cret-pass" || account.Login != "joe" || !account.Notify || time.Duration(account.Timeout) != 30*time.Second {
+			t.Errorf("%s: after set: %+v", name, account)
+		}
+
+		out := capture(t, func() {
+			app.Run([]string{"--admin", "users", "list", "--db", dbpath})
+		})
+		if !strings.Contains(out, "owner@example.com") || !strings.Contains(out, "other@example.com") || strings.Contains(out, "s3cret-pass") {
+			t.Errorf("%s: list: %q, want both accounts and not the password", name, out)
+		}
+
+		// qmail's user must still be able to read the database after an edit
+		if err = os.Chmod(dbpath, 0640); err != nil {
+			t.Fatal(err)
+		}
+		if exit := app.Run([]string{"--admin", "users", "remove", "--db", dbpath, "other", "example.com"}); exit != 0 {
+			t.Errorf("%s: remove: exit %d", name, exit)
+		}
+		out = capture(t, func() {
+			app.Run([]string{"--admin", "users", "list", "--db", dbpath, "owner", "example.com"})
+		})
+		if !strings.Contains(out, "owner@example.com") || strings.Contains(out, "other@example.com") {
+			t.Errorf("%s: list after remove: %q", name, out)
+		}
+		if info, err := os.Stat(dbpath); err != nil || info.Mode().Perm() != 0640 {
+			t.Errorf("%s: mode after remove %v, %v, want 0640", name, info.Mode(), err)
+		}
+	}
+}
+
+// TestUsersConcurrent tests that users commands run at the same time don't
+// lose each other's changes
+func TestUsersConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestUsersConcurrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbpath := filepath.Join(dir, "users.json")
+	const n = 8
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			owner := fmt.Sprintf("owner%d", i)
+			if exit := app.Run([]string{"--admin", "users", "add", "--db", dbpath, owner, "example.com", "file://" + dir}); exit != 0 {
+				t.Errorf("add %s: exit %d", owner, exit)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	db, err := users.Load(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.Accounts) != n {
+		t.Fatalf("%d accounts, want %d", len(db.Accounts), n)
+	}
+}
+
+// TestMigrateUsers tests rewriting an old user database in the current format
+func TestMigrateUsers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMigrateUsers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbpath := filepath.Join(dir, "users.json")
+	v1 := `{"version": 1, "accounts": [{"owner": "Joe", "domain": "example.com", "url": "file:///tmp"}]}`
+	if err = ioutil.WriteFile(dbpath, []byte(v1), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if exit := app.Run([]string{"--admin", "users", "migrate", "--db", dbpath}); exit != 0 {
+		t.Fatalf("users migrate: exit %d", exit)
+	}
+	buf, err := ioutil.ReadFile(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf(`"version": %d`, users.Version)
+	if !strings.Contains(string(buf), want) || !strings.Contains(string(buf), `"owner": "joe"`) {
+		t.Errorf("after migrate: %s, want %s and a lower case owner", buf, want)
+	}
+
+	if err = ioutil.WriteFile(dbpath, []byte(`{"version": 1, "accounts": [{"owner": "joe", "domain": "example.com", "url": "file:///tmp", "extra": 1}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if exit := app.Run([]string{"--admin", "users", "migrate", "--db", dbpath}); exit != 1 {
+		t.Errorf("users migrate with an unknown field: exit %d, want 1", exit)
+	}
+}
+
+// TestCommandOwner tests that mail to an owner named after a command is
+// delivered, with or without "--" in the .qmail line
+func TestCommandOwner(t *testing.T) {
+	domain := "example.com"
+
+	handler, err := filepath.Abs("testdata/handler.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "TestCommandOwner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	udata := &users.Users{
+		Version: users.Version,
+		Accounts: []users.Account{
+			{Owner: "lint", Domain: domain, URL: "file://" + dir},
+			{Owner: "users", Domain: domain, URL: "file://" + dir},
+		},
+	}
+	if err = udata.Save(filepath.Join(dir, "users.json")); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink(handler, filepath.Join(dir, "qdeliver-handler.sh")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"lint.txt", "users.txt"} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(`sh -c "exit 0"`), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the defaults of --db and --handler are in the current directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	var tests = []struct {
+		args []string
+		exit int
+	}{
+		{[]string{"users", domain}, 0},
+		{[]string{"lint", domain}, 0},
+		{[]string{"--", "lint", domain}, 0},
+		{[]string{"lint-foo", domain}, 100},
+	}
+	for _, test := range tests {
+		if exit := app.Run(test.args); exit != test.exit {
+			t.Errorf("%v: exit %d, want %d", test.args, exit, test.exit)
+		}
+	}
+}
+
+// TestSignedLayout tests that sidecar signatures are written where the
+// account's layout looks for them
+func TestSignedLayout(t *testing.T) {
+	owner := "al"
+	domain := "example.com"
+
+	dir, err := ioutil.TempDir("", "TestSignedLayout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyfile := filepath.Join(dir, "key")
+	pub := strings.TrimSpace(capture(t, func() {
+		app.Run([]string{"--admin", "sign", "--key", keyfile, "--generate"})
+	}))
+
+	noext := ""
+	udata := &users.Users{
+		Version: users.Version,
+		Accounts: []users.Account{
+			{
+				Owner:     owner,
+				Domain:    domain,
+				URL:       "file://" + dir,
+				PublicKey: pub,
+				Layout:    &users.Layout{Extension: &noext, OwnerDir: true, Shard: 3},
+			},
+		},
+	}
+	dbpath := filepath.Join(dir, "users.json")
+	if err = udata.Save(dbpath); err != nil {
+		t.Fatal(err)
+	}
+
+	// shard 3 is longer than "al", and "al-x.y" has a dot but no extension
+	files := []string{"al/d/de/def/default", "al/a/al/al/al", "al/a/al/al-/al-x.y"}
+	args := []string{"--admin", "sign", "--key", keyfile, "--sidecar", "--extension", "", "--shard", "3"}
+	for _, name := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(name, []byte(`sh -c "exit 0"`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		args = append(args, name)
+	}
+	if exit := app.Run(args); exit != 0 {
+		t.Fatalf("%v: exit %d", args, exit)
+	}
+	for _, name := range []string{"al/a/al/al./al.sig", "al/a/al/al-/al-x.y.sig"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			t.Errorf("sidecar %s: %v", name, err)
+		}
+	}
+
+	for _, localpart := range []string{owner, owner + "-x.y", owner + "-new"} {
+		exit := app.Run([]string{"--db", dbpath, "--handler", "testdata/handler.sh", localpart, domain})
+		if exit != 0 {
+			t.Errorf("%s: exit %d, want 0", localpart, exit)
+		}
+	}
+
+	// a file that isn't where the layout would put it can't be placed
+	if exit := app.Run([]string{"--admin", "sign", "--key", keyfile, "--sidecar", filepath.Join(dir, "al/a/al/al/al")}); exit != 1 {
+		t.Errorf("sign in the wrong layout: exit %d, want 1", exit)
+	}
+}
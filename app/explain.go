@@ -0,0 +1,194 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/wavemechanics/qdeliver/instruction"
+	"github.com/wavemechanics/qdeliver/lookup"
+	"github.com/wavemechanics/qdeliver/users"
+)
+
+// Explain shows how mail to an address would be handled. It follows the
+// same steps as Run, but never runs any instructions or writes to storage.
+// The exit status is 100 if the mail would bounce before any instructions
+// are run, 1 if it would be deferred, and 0 otherwise.
+//
+func Explain(args []string) int {
+	var dbpath string
+
+	flags := flag.NewFlagSet("explain", flag.ContinueOnError)
+	flags.StringVar(&dbpath, "db", "users.json", "path to user database")
+
+	u := usage{
+		Flags:    flags,
+		Synopsis: []string{"--admin explain [options] localpart domain"},
+	}
+	flags.Usage = u.Usage
+
+	if err := flags.Parse(args); err != nil {
+		log.Println(err)
+		return 2
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+
+	localpart, owner, domain, ok := address(flags.Arg(0), flags.Arg(1))
+	if !ok {
+		flags.Usage()
+		return 2
+	}
+	fmt.Printf("address:  %s@%s\n", localpart, domain)
+
+	db, err := users.Open(dbpath)
+	if err != nil {
+		fmt.Printf("userdb:   %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	account, err := db.Lookup(owner, domain)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("account:  %s@%s is not in %s; mail would bounce\n", owner, domain, dbpath)
+		return 100
+	}
+	if err != nil {
+		fmt.Printf("account:  %v\n", err)
+		return 1
+	}
+	printAccount(account)
+
+	storage, err := open(account)
+	if err != nil {
+		fmt.Printf("storage:  %v\n", err)
+		return 1
+	}
+	storage, err = verified(account, storage)
+	if err != nil {
+		fmt.Printf("storage:  %v\n", err)
+		return 1
+	}
+	files, _ := account.FileLayout() // already checked by open
+	ctx, cancel := context.WithTimeout(context.Background(), timeout(account))
+	defer cancel()
+
+	key, contents, err := lookup.Resolve(ctx, storage, localpart)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("file:     neither %s nor %s exists; mail would bounce\n", files.Name(localpart), files.Name(lookup.Default))
+		return 100
+	}
+	if err != nil {
+		fmt.Printf("file:     %v; mail would be deferred\n", err)
+		return 1
+	}
+	if key == localpart {
+		fmt.Printf("file:     %s\n", files.Name(key))
+	} else {
+		fmt.Printf("file:     %s would be created from %s\n", files.Name(localpart), files.Name(key))
+		if account.Notify {
+			fmt.Printf("notify:   %s@%s would be told about the new address\n", owner, domain)
+		}
+	}
+
+	return printInstructions(contents)
+}
+
+// printAccount shows the user database entry for an address, without its password.
+//
+func printAccount(account *users.Account) {
+	password := "(none)"
+	switch {
+	case account.PasswordFile != "":
+		password = "(from file " + account.PasswordFile + ")"
+	case account.PasswordEnv != "":
+		password = "(from $" + account.PasswordEnv + ")"
+	case account.PasswordCommand != "":
+		password = "(from command " + account.PasswordCommand + ")"
+	case account.Password != "":
+		password = "(redacted)"
+	}
+	fmt.Printf("account:  %s@%s\n", account.Owner, account.Domain)
+	fmt.Printf("url:      %s\n", account.URL)
+	for _, u := range account.Fallbacks {
+		if account.Replicate {
+			u += " (replicated)"
+		}
+		fmt.Printf("fallback: %s\n", u)
+	}
+	fmt.Printf("login:    %s\n", account.Login)
+	fmt.Printf("password: %s\n", password)
+	if a := account.Auth; a != nil {
+		mode := a.Mode
+		if mode == "" {
+			mode = "basic"
+		}
+		if a.Cert != "" {
+			mode += ", client certificate " + a.Cert
+		}
+		fmt.Printf("auth:     %s\n", mode)
+	}
+	if t := account.TLS; t != nil {
+		var settings []string
+		if t.CA != "" {
+			settings = append(settings, "ca "+t.CA)
+		}
+		if t.Pin != "" {
+			settings = append(settings, "pin "+t.Pin)
+		}
+		if t.MinVersion != "" {
+			settings = append(settings, "min_version "+t.MinVersion)
+		}
+		fmt.Printf("tls:      %s\n", strings.Join(settings, ", "))
+	}
+	if account.PublicKey != "" {
+		fmt.Printf("signed:   files must be signed by %s\n", account.PublicKey)
+	}
+	fmt.Printf("notify:   %v\n", account.Notify)
+	fmt.Printf("timeout:  %v\n", timeout(account))
+}
+
+// printInstructions shows the parsed contents of an address file, and
+// returns 1 if delivery would be deferred because of problems in it.
+//
+func printInstructions(contents string) int {
+	list, err := instruction.Parse(contents)
+
+	fmt.Println("instructions:")
+	if len(list) == 0 {
+		fmt.Println("    (none; mail would be accepted and discarded)")
+	}
+	for _, in := range list {
+		fmt.Printf("    %d:%d\t%s", in.Line, in.Col, in.Keyword)
+		for _, flag := range in.Flags {
+			fmt.Printf(" -%c", flag)
+		}
+		for _, arg := range in.Args {
+			fmt.Printf(" %q", arg)
+		}
+		if _, ok := instruction.Keywords[in.Keyword]; !ok {
+			fmt.Print("\t(passed to handler)")
+		}
+		fmt.Println()
+	}
+
+	status := 0
+	errs, _ := err.(instruction.ErrorList)
+	for _, e := range errs {
+		if errors.Is(e, instruction.ErrUnknownKeyword) {
+			continue
+		}
+		if status == 0 {
+			fmt.Println("problems; mail would be deferred:")
+		}
+		fmt.Printf("    %v\n", e)
+		status = 1
+	}
+	return status
+}
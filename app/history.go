@@ -0,0 +1,121 @@
+package app
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/wavemechanics/qdeliver/lookup"
+	"github.com/wavemechanics/qdeliver/store"
+	"github.com/wavemechanics/qdeliver/store/git"
+	"github.com/wavemechanics/qdeliver/users"
+)
+
+// historian is a Storage that keeps earlier versions of its values, such
+// as git.Storage.
+//
+type historian interface {
+	store.Storage
+	History(ctx context.Context, key string) ([]git.Version, error)
+	GetAt(ctx context.Context, key, commit string) (string, error)
+	Rollback(ctx context.Context, key, commit string) error
+}
+
+// History lists the earlier versions of an address file, for accounts
+// whose url keeps a history, and can show one of them or restore it.
+// --default uses the default file instead of the address's own.
+//
+func History(args []string) int {
+	var dbpath string
+	var show string
+	var rollback string
+	var useDefault bool
+
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	flags.StringVar(&dbpath, "db", "users.json", "path to user database")
+	flags.StringVar(&show, "show", "", "print the file as it was in this commit")
+	flags.StringVar(&rollback, "rollback", "", "restore the file to the way it was in this commit")
+	flags.BoolVar(&useDefault, "default", false, "use the default file of the address's account")
+
+	u := usage{
+		Flags:    flags,
+		Synopsis: []string{"--admin history [options] localpart domain"},
+	}
+	flags.Usage = u.Usage
+
+	if err := flags.Parse(args); err != nil {
+		log.Println(err)
+		return 2
+	}
+	if flags.NArg() != 2 || show != "" && rollback != "" {
+		flags.Usage()
+		return 2
+	}
+	localpart, owner, domain, ok := address(flags.Arg(0), flags.Arg(1))
+	if !ok {
+		flags.Usage()
+		return 2
+	}
+	key := localpart
+	if useDefault {
+		key = lookup.Default
+	}
+
+	db, err := users.Open(dbpath)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer db.Close()
+	account, err := db.Lookup(owner, domain)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	// only the primary url; fallbacks are copies without their own history
+	options, err := storeOptions(account)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	storage, err := store.Open(account.URL, options)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	h, ok := storage.(historian)
+	if !ok {
+		log.Printf("%s@%s: %s keeps no history", owner, domain, account.URL)
+		return 1
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout(account))
+	defer cancel()
+
+	switch {
+	case show != "":
+		contents, err := h.GetAt(ctx, key, show)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		fmt.Print(contents)
+	case rollback != "":
+		if err := h.Rollback(ctx, key, rollback); err != nil {
+			log.Println(err)
+			return 1
+		}
+	default:
+		versions, err := h.History(ctx, key)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		for _, v := range versions {
+			fmt.Printf("%.12s  %s  %s  %s\n", v.Commit, v.Time.Format(time.RFC3339), v.Author, v.Message)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,218 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/wavemechanics/qdeliver/deliver"
+	"github.com/wavemechanics/qdeliver/instruction"
+	"github.com/wavemechanics/qdeliver/lookup"
+	"github.com/wavemechanics/qdeliver/store"
+	"github.com/wavemechanics/qdeliver/store/layout"
+	"github.com/wavemechanics/qdeliver/users"
+)
+
+// Lint checks every address file for one account in the user database, or
+// for all of them. Problems are printed one per line, as
+// "owner@domain: file:line:col: problem".
+// It returns 1 if any errors were found, and 0 if there were none,
+// even if there were warnings.
+//
+func Lint(args []string) int {
+	var dbpath string
+	var allow string
+
+	flags := flag.NewFlagSet("lint", flag.ContinueOnError)
+	flags.StringVar(&dbpath, "db", "users.json", "path to user database")
+	flags.StringVar(&allow, "allow", "", "comma separated keywords known to the handler script")
+
+	u := usage{
+		Flags:    flags,
+		Synopsis: []string{"--admin lint [options] [owner domain]"},
+	}
+	flags.Usage = u.Usage
+
+	if err := flags.Parse(args); err != nil {
+		log.Println(err)
+		return 2
+	}
+	if flags.NArg() != 0 && flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+
+	db, err := users.Load(dbpath)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	status := 0
+	if err := users.CheckSecrets(dbpath, db); err != nil {
+		fmt.Println(err)
+		status = 1
+	}
+
+	accounts := db.Accounts
+	if flags.NArg() == 2 {
+		owner, domain := strings.ToLower(flags.Arg(0)), flags.Arg(1)
+		accounts = nil
+		for _, account := range db.Accounts {
+			if account.Owner == owner && account.Domain == domain {
+				accounts = append(accounts, account)
+				break // the one Lookup finds
+			}
+		}
+		if len(accounts) == 0 {
+			log.Printf("%s@%s: not in %s", flags.Arg(0), flags.Arg(1), dbpath)
+			return 1
+		}
+	}
+
+	known := make(map[string]bool)
+	for _, keyword := range strings.Split(allow, ",") {
+		if keyword = strings.TrimSpace(keyword); keyword != "" {
+			known[keyword] = true
+		}
+	}
+
+	for i := range accounts {
+		l := linter{
+			account: &accounts[i],
+			known:   known,
+		}
+		l.lint()
+		if l.errors != 0 {
+			status = 1
+		}
+	}
+	return status
+}
+
+// linter checks the address files of a single account.
+//
+type linter struct {
+	account *users.Account
+	files   layout.Layout
+	known   map[string]bool // handler keywords that aren't errors
+	errors  int
+}
+
+func (l *linter) lint() {
+	if err := l.account.ResolvePassword(); err != nil {
+		l.error("", err)
+		return
+	}
+	storage, err := open(l.account)
+	if err != nil {
+		l.error("", err)
+		return
+	}
+	storage, err = verified(l.account, storage)
+	if err != nil {
+		l.error("", err)
+		return
+	}
+	l.files, _ = l.account.FileLayout() // already checked by open
+	lister, ok := storage.(store.Lister)
+	if !ok {
+		l.error("", errors.New("storage cannot list address files"))
+		return
+	}
+
+	// each request gets as long as a delivery would, rather than the whole
+	// account, which may have thousands of files
+	ctx, cancel := context.WithTimeout(context.Background(), timeout(l.account))
+	keys, err := lister.List(ctx)
+	cancel()
+	if err != nil {
+		l.error("", err)
+		return
+	}
+
+	hasDefault := false
+	for _, key := range keys {
+		if strings.HasSuffix(key, deliver.CounterSuffix) {
+			continue // not an address file
+		}
+		if key == lookup.Default {
+			hasDefault = true
+		}
+		contents, err := l.get(lister, key)
+		if err != nil {
+			l.error(key, err)
+			continue
+		}
+		l.check(key, contents)
+	}
+	if !hasDefault {
+		l.warn(lookup.Default, "missing; mail to new addresses will bounce")
+	}
+}
+
+// get reads the address file key from storage.
+//
+func (l *linter) get(storage store.Storage, key string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout(l.account))
+	defer cancel()
+	return storage.Get(ctx, key)
+}
+
+// check reports the problems in the contents of one address file.
+//
+func (l *linter) check(key, contents string) {
+	list, err := instruction.Parse(contents)
+
+	keywords := make(map[int]string) // line number to keyword
+	for _, in := range list {
+		keywords[in.Line] = in.Keyword
+	}
+
+	errs, _ := err.(instruction.ErrorList)
+	for _, e := range errs {
+		if errors.Is(e, instruction.ErrUnknownKeyword) && l.known[keywords[e.Line]] {
+			continue
+		}
+		l.errors++
+		fmt.Printf("%s:%v\n", l.where(key), e)
+	}
+	signed := l.account.PublicKey != ""
+	for _, in := range list {
+		if in.Keyword != "expires" || len(in.Args) == 0 || key == lookup.Default && !signed {
+			continue
+		}
+		if t, _, err := instruction.ParseExpiry(in.Args[0]); err == nil && t.IsZero() {
+			l.errors++
+			if signed {
+				fmt.Printf("%s:%d:%d: relative date can't be made absolute in signed files\n", l.where(key), in.Line, in.Col)
+			} else {
+				fmt.Printf("%s:%d:%d: relative date is only made absolute in %s\n", l.where(key), in.Line, in.Col, l.files.Name(lookup.Default))
+			}
+		}
+	}
+	if len(list) == 0 && len(errs) == 0 {
+		l.warn(key, "no instructions; mail will be accepted and discarded")
+	}
+}
+
+func (l *linter) error(key string, err error) {
+	l.errors++
+	fmt.Printf("%s: %v\n", l.where(key), err)
+}
+
+func (l *linter) warn(key string, msg string) {
+	fmt.Printf("%s: warning: %s\n", l.where(key), msg)
+}
+
+// where names an account, and optionally one of its address files.
+//
+func (l *linter) where(key string) string {
+	where := l.account.Owner + "@" + l.account.Domain
+	if key != "" {
+		where += ": " + l.files.Name(key)
+	}
+	return where
+}
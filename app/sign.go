@@ -0,0 +1,169 @@
+package app
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/wavemechanics/qdeliver/sign"
+	"github.com/wavemechanics/qdeliver/store/layout"
+	"github.com/wavemechanics/qdeliver/store/signed"
+	"github.com/wavemechanics/qdeliver/users"
+)
+
+// Sign signs address files for accounts with a public key, usually in a
+// locally mounted copy of the account's directory. Each file gets a
+// signature trailer, or with --sidecar, a separate signature file.
+// --generate makes a new private key, and --public prints the public key
+// to put in the user database.
+//
+func Sign(args []string) int {
+	var keyfile string
+	var generate bool
+	var public bool
+	var sidecar bool
+	var extension string
+	var shard int
+
+	flags := flag.NewFlagSet("sign", flag.ContinueOnError)
+	flags.StringVar(&keyfile, "key", "", "file holding the private key")
+	flags.BoolVar(&generate, "generate", false, "write a new private key to the key file and print its public key")
+	flags.BoolVar(&public, "public", false, "print the public key for the key file")
+	flags.BoolVar(&sidecar, "sidecar", false, "write signatures to separate .sig files instead of a trailer")
+	flags.StringVar(&extension, "extension", layout.Default.Ext, "extension of address files in the account's layout, for --sidecar")
+	flags.IntVar(&shard, "shard", layout.Default.Shard, "shard directories in the account's layout, for --sidecar")
+
+	u := usage{
+		Flags: flags,
+		Synopsis: []string{
+			"--admin sign --key file [--sidecar [--extension ext] [--shard n]] file...",
+			"--admin sign --key file --generate|--public",
+		},
+	}
+	flags.Usage = u.Usage
+
+	if err := flags.Parse(args); err != nil {
+		log.Println(err)
+		return 2
+	}
+	if keyfile == "" || generate && public || (generate || public) != (flags.NArg() == 0) {
+		flags.Usage()
+		return 2
+	}
+	// the owner directory is the same for a file and its sidecar, so
+	// files are placed relative to it
+	l, err := (&users.Account{Layout: &users.Layout{Extension: &extension, Shard: shard}}).FileLayout()
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	if generate {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err == nil {
+			err = writeKey(keyfile, priv)
+		}
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(pub))
+		return 0
+	}
+
+	buf, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	priv, err := sign.ParsePrivateKey(string(buf))
+	if err != nil {
+		log.Printf("%s: %v", keyfile, err)
+		return 1
+	}
+	if public {
+		fmt.Println(base64.StdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey)))
+		return 0
+	}
+
+	status := 0
+	for _, name := range flags.Args() {
+		if err := signFile(name, priv, sidecar, l); err != nil {
+			log.Println(err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// writeKey writes the seed of a new private key to a file only its owner
+// can read. An existing file isn't replaced.
+//
+func writeKey(name string, priv ed25519.PrivateKey) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, base64.StdEncoding.EncodeToString(priv.Seed()))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// signFile adds a signature trailer to the file name, or if sidecar is set,
+// writes its signature to the file store/signed reads it from: the one for
+// the file's key plus SigSuffix in layout l. So in the default layout,
+// "joe.txt" is signed by "joe.sig.txt".
+//
+func signFile(name string, priv ed25519.PrivateKey, sidecar bool, l layout.Layout) error {
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	contents := string(buf)
+
+	if !sidecar {
+		return ioutil.WriteFile(name, []byte(sign.Embed(contents, priv)), info.Mode().Perm())
+	}
+	if _, ok := sign.Trailer(contents); ok {
+		return fmt.Errorf("%s: already has a signature trailer", name)
+	}
+	sigfile, err := sidecarName(name, l)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(sigfile), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(sigfile, []byte(sign.Sign(contents, priv)+"\n"), info.Mode().Perm())
+}
+
+// sidecarName returns the name of the sidecar signature file for the
+// address file name in layout l. The key is the file's base name less
+// l.Ext, and name must be where l puts it, below some directory; the
+// sidecar is put below the same directory. Shard directories can differ,
+// since they are named after the start of the key.
+//
+func sidecarName(name string, l layout.Layout) (string, error) {
+	slashed := filepath.ToSlash(name)
+	base := path.Base(slashed)
+	key := strings.TrimSuffix(base, l.Ext)
+	if !strings.HasSuffix(base, l.Ext) || key == "" || !strings.HasSuffix("/"+slashed, "/"+l.Name(key)) {
+		return "", fmt.Errorf("%s: not where the layout puts an address file; check --extension and --shard", name)
+	}
+	root := strings.TrimSuffix(slashed, l.Name(key))
+	return filepath.FromSlash(root + l.Name(key+signed.SigSuffix)), nil
+}
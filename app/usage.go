@@ -11,10 +11,17 @@ import (
 // PrintDefaults.
 //
 type usage struct {
-	Flags *flag.FlagSet
+	Flags    *flag.FlagSet
+	Synopsis []string // command lines to show, without the program name
 }
 
 func (u *usage) Usage() {
-	fmt.Fprintf(u.Flags.Output(), "usage: %s [options] localpart domain\n", os.Args[0])
+	for i, synopsis := range u.Synopsis {
+		prefix := "usage:"
+		if i > 0 {
+			prefix = "      "
+		}
+		fmt.Fprintf(u.Flags.Output(), "%s %s %s\n", prefix, os.Args[0], synopsis)
+	}
 	u.Flags.PrintDefaults()
 }
@@ -0,0 +1,421 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/wavemechanics/qdeliver/users"
+)
+
+// usersCommands are the subcommands of Users.
+//
+var usersCommands = map[string]func(args []string) int{
+	"add":     addUser,
+	"compile": compileUsers,
+	"list":    listUsers,
+	"migrate": migrateUsers,
+	"remove":  removeUser,
+	"set":     setUser,
+}
+
+// usersSynopsis shows how to use each of usersCommands.
+//
+var usersSynopsis = []string{
+	"--admin users add [options] owner domain url",
+	"--admin users remove [options] owner domain",
+	"--admin users list [options] [owner domain]",
+	"--admin users set [options] owner domain field=value...",
+	"--admin users compile users.json users.cdb",
+	"--admin users migrate [options]",
+}
+
+// Users manages the user database. Its first argument names what to do.
+//
+func Users(args []string) int {
+	if len(args) > 0 {
+		if command, ok := usersCommands[args[0]]; ok {
+			return command(args[1:])
+		}
+	}
+	u := usage{
+		Flags:    flag.NewFlagSet("users", flag.ContinueOnError),
+		Synopsis: usersSynopsis,
+	}
+	u.Usage()
+	return 2
+}
+
+// usersFlags returns the flags for the users subcommand name, which all
+// have --db.
+//
+func usersFlags(name string, dbpath *string, synopsis string) *flag.FlagSet {
+	flags := flag.NewFlagSet("users "+name, flag.ContinueOnError)
+	flags.StringVar(dbpath, "db", "users.json", "path to user database, JSON or cdb")
+	u := usage{
+		Flags:    flags,
+		Synopsis: []string{synopsis},
+	}
+	flags.Usage = u.Usage
+	return flags
+}
+
+// editUsers loads the user database at path, lets edit change it, and
+// saves it in the same format if the result is valid. If create is set,
+// a database that doesn't exist is started empty. The database is locked
+// throughout, so edits made at the same time are made one after another.
+//
+func editUsers(path string, create bool, edit func(db *users.Users) error) error {
+	unlock, err := users.Lock(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	db, err := users.Load(path)
+	if errors.Is(err, os.ErrNotExist) && create {
+		db, err = &users.Users{Version: users.Version}, nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = edit(db); err != nil {
+		return err
+	}
+	if err = db.Validate(); err != nil {
+		return err
+	}
+	if isCDB, _ := users.IsCDB(path); isCDB {
+		return db.SaveCDB(path)
+	}
+	return db.Save(path)
+}
+
+// migrateUsers rewrites the user database in the current version of its
+// format. Other changes do that too, but this makes no others.
+//
+func migrateUsers(args []string) int {
+	var dbpath string
+
+	flags := usersFlags("migrate", &dbpath, usersSynopsis[5])
+	if err := flags.Parse(args); err != nil {
+		log.Println(err)
+		return 2
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	err := editUsers(dbpath, false, func(db *users.Users) error {
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// find returns the index of the account for owner@domain in db, or -1.
+//
+func find(db *users.Users, owner, domain string) int {
+	for i, account := range db.Accounts {
+		if account.Owner == owner && account.Domain == domain {
+			return i
+		}
+	}
+	return -1
+}
+
+// addUser adds an account to the user database, creating the database if
+// it doesn't exist. Only the most common settings have flags; the rest
+// can be changed with "users set".
+//
+func addUser(args []string) int {
+	var dbpath string
+	var account users.Account
+	var timeout time.Duration
+	var stdin bool
+
+	flags := usersFlags("add", &dbpath, usersSynopsis[0])
+	flags.StringVar(&account.Login, "login", "", "webdav login")
+	flags.BoolVar(&stdin, "password-stdin", false, "read the webdav password from standard input")
+	flags.StringVar(&account.PasswordFile, "password-file", "", "file holding the webdav password")
+	flags.StringVar(&account.PasswordEnv, "password-env", "", "environment variable holding the webdav password")
+	flags.StringVar(&account.PasswordCommand, "password-command", "", "command that prints the webdav password")
+	flags.BoolVar(&account.Notify, "notify", false, "tell the owner about new addresses")
+	flags.DurationVar(&timeout, "timeout", 0, "how long handling a message may take")
+
+	if err := flags.Parse(args); err != nil {
+		log.Println(err)
+		return 2
+	}
+	if flags.NArg() != 3 {
+		flags.Usage()
+		return 2
+	}
+	account.Owner = strings.ToLower(flags.Arg(0))
+	account.Domain = flags.Arg(1)
+	account.URL = flags.Arg(2)
+	account.Timeout = users.Duration(timeout)
+
+	if stdin {
+		password, err := readPassword()
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		account.Password = password
+	}
+
+	err := editUsers(dbpath, true, func(db *users.Users) error {
+		if find(db, account.Owner, account.Domain) >= 0 {
+			return fmt.Errorf("%s@%s: already in %s", account.Owner, account.Domain, dbpath)
+		}
+		db.Accounts = append(db.Accounts, account)
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// readPassword reads a password from the first line of standard input,
+// so that it isn't seen in ps output or shell history.
+//
+func readPassword() (string, error) {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("reading password: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// removeUser removes an account from the user database.
+//
+func removeUser(args []string) int {
+	var dbpath string
+
+	flags := usersFlags("remove", &dbpath, usersSynopsis[1])
+	if err := flags.Parse(args); err != nil {
+		log.Println(err)
+		return 2
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	owner, domain := strings.ToLower(flags.Arg(0)), flags.Arg(1)
+
+	err := editUsers(dbpath, false, func(db *users.Users) error {
+		i := find(db, owner, domain)
+		if i < 0 {
+			return fmt.Errorf("%s@%s: not in %s", owner, domain, dbpath)
+		}
+		db.Accounts = append(db.Accounts[:i], db.Accounts[i+1:]...)
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// listUsers shows the accounts in the user database, or just one of them,
+// without their passwords.
+//
+func listUsers(args []string) int {
+	var dbpath string
+
+	flags := usersFlags("list", &dbpath, usersSynopsis[2])
+	if err := flags.Parse(args); err != nil {
+		log.Println(err)
+		return 2
+	}
+	if flags.NArg() != 0 && flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+
+	db, err := users.Load(dbpath)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	accounts := db.Accounts
+	if flags.NArg() == 2 {
+		owner, domain := strings.ToLower(flags.Arg(0)), flags.Arg(1)
+		i := find(db, owner, domain)
+		if i < 0 {
+			log.Printf("%s@%s: not in %s", owner, domain, dbpath)
+			return 1
+		}
+		accounts = accounts[i : i+1]
+	}
+
+	for i := range accounts {
+		if i > 0 {
+			fmt.Println()
+		}
+		printAccount(&accounts[i])
+	}
+	return 0
+}
+
+// setUser changes settings of an account in the user database. Each
+// argument after the owner and domain is a field name from the database,
+// an "=", and the new value, which is JSON, or if it isn't valid JSON
+// for the field, a string. An empty value removes the setting.
+// A password can only be given on standard input, with --password-stdin.
+//
+func setUser(args []string) int {
+	var dbpath string
+	var stdin bool
+
+	flags := usersFlags("set", &dbpath, usersSynopsis[3])
+	flags.BoolVar(&stdin, "password-stdin", false, "read the webdav password from standard input")
+	if err := flags.Parse(args); err != nil {
+		log.Println(err)
+		return 2
+	}
+	if flags.NArg() < 2 || (flags.NArg() == 2 && !stdin) {
+		flags.Usage()
+		return 2
+	}
+	owner, domain := strings.ToLower(flags.Arg(0)), flags.Arg(1)
+
+	for _, assignment := range flags.Args()[2:] {
+		if strings.HasPrefix(assignment, "password=") && assignment != "password=" {
+			log.Printf("%s@%s: give the password with --password-stdin, not on the command line", owner, domain)
+			return 2
+		}
+	}
+	var password string
+	if stdin {
+		var err error
+		if password, err = readPassword(); err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+
+	err := editUsers(dbpath, false, func(db *users.Users) error {
+		i := find(db, owner, domain)
+		if i < 0 {
+			return fmt.Errorf("%s@%s: not in %s", owner, domain, dbpath)
+		}
+		for _, assignment := range flags.Args()[2:] {
+			if err := setField(&db.Accounts[i], assignment); err != nil {
+				return fmt.Errorf("%s@%s: %v", owner, domain, err)
+			}
+		}
+		if stdin {
+			db.Accounts[i].Password = password
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// setField changes one setting of account, given as "field=value".
+//
+func setField(account *users.Account, assignment string) error {
+	eq := strings.Index(assignment, "=")
+	if eq <= 0 {
+		return fmt.Errorf("%q is not field=value", assignment)
+	}
+	name, value := assignment[:eq], assignment[eq+1:]
+
+	buf, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(buf, &fields); err != nil {
+		return err
+	}
+
+	var values []json.RawMessage // to try in turn
+	if json.Valid([]byte(value)) {
+		values = append(values, json.RawMessage(value))
+	}
+	quoted, _ := json.Marshal(value)
+	values = append(values, quoted)
+
+	for _, v := range values {
+		if value == "" {
+			delete(fields, name)
+		} else {
+			fields[name] = v
+		}
+		buf, err = json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		dec := json.NewDecoder(bytes.NewReader(buf))
+		dec.DisallowUnknownFields()
+		var changed users.Account
+		if err = dec.Decode(&changed); err == nil {
+			*account = changed
+			return nil
+		}
+	}
+	if strings.Contains(err.Error(), "unknown field") {
+		return fmt.Errorf("no setting %q", name)
+	}
+	return fmt.Errorf("%s: %v", name, err)
+}
+
+// compileUsers writes a user database in cdb format, for installations
+// with so many accounts that reading the JSON database for every
+// delivery is slow. The cdb file replaces the old one in a single step.
+//
+func compileUsers(args []string) int {
+	flags := flag.NewFlagSet("users compile", flag.ContinueOnError)
+	u := usage{
+		Flags:    flags,
+		Synopsis: []string{usersSynopsis[4]},
+	}
+	flags.Usage = u.Usage
+
+	if err := flags.Parse(args); err != nil {
+		log.Println(err)
+		return 2
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+
+	db, err := users.Load(flags.Arg(0))
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	unlock, err := users.Lock(flags.Arg(1))
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer unlock()
+	if err = db.SaveCDB(flags.Arg(1)); err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
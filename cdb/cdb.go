@@ -0,0 +1,334 @@
+package cdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/wavemechanics/etype"
+)
+
+const (
+	ErrTooBig  = etype.Sentinel("database would be over 4GB")
+	ErrCorrupt = etype.Sentinel("not a valid cdb file")
+)
+
+// headerSize is the size of the table of hash table positions at the
+// start of a file: 256 pairs of little-endian uint32s.
+//
+const headerSize = 256 * 8
+
+// hash is the cdb hash function.
+//
+func hash(key []byte) uint32 {
+	h := uint32(5381)
+	for _, c := range key {
+		h = ((h << 5) + h) ^ uint32(c)
+	}
+	return h
+}
+
+// CDB is an open constant database, as made by cdbmake. Records are read
+// from the file as they are needed, so a lookup takes a few small reads
+// however big the file is.
+//
+type CDB struct {
+	r      io.ReaderAt
+	closer io.Closer
+	header [headerSize]byte
+}
+
+// Open opens the cdb file path.
+//
+func Open(path string) (*CDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := New(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	db.closer = f
+	return db, nil
+}
+
+// New returns a CDB reading from r.
+//
+func New(r io.ReaderAt) (*CDB, error) {
+	db := &CDB{r: r}
+	if _, err := r.ReadAt(db.header[:], 0); err != nil {
+		if err == io.EOF {
+			err = ErrCorrupt
+		}
+		return nil, err
+	}
+	return db, nil
+}
+
+// Close closes the file opened by Open.
+//
+func (db *CDB) Close() error {
+	if db.closer == nil {
+		return nil
+	}
+	return db.closer.Close()
+}
+
+// Get returns the value of the first record with key. If there isn't
+// one, it returns an error wrapping os.ErrNotExist.
+//
+func (db *CDB) Get(key []byte) ([]byte, error) {
+	h := hash(key)
+	slot := h & 0xff
+	tpos := binary.LittleEndian.Uint32(db.header[slot*8:])
+	tlen := binary.LittleEndian.Uint32(db.header[slot*8+4:])
+	if tlen == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	var buf [8]byte
+	start := (h >> 8) % tlen
+	for i := uint32(0); i < tlen; i++ {
+		pos := int64(tpos) + int64((start+i)%tlen)*8
+		if err := db.read(buf[:], pos); err != nil {
+			return nil, err
+		}
+		sh := binary.LittleEndian.Uint32(buf[:])
+		rpos := binary.LittleEndian.Uint32(buf[4:])
+		if rpos == 0 {
+			break // empty slot: not found
+		}
+		if sh != h {
+			continue
+		}
+		k, v, err := db.record(int64(rpos))
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(k, key) {
+			return db.value(v)
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// ForEach calls f with every record in the order they were added,
+// stopping at the first error f returns.
+//
+func (db *CDB) ForEach(f func(key, value []byte) error) error {
+	end := int64(binary.LittleEndian.Uint32(db.header[:])) // first hash table
+	for pos := int64(headerSize); pos < end; {
+		k, v, err := db.record(pos)
+		if err != nil {
+			return err
+		}
+		value, err := db.value(v)
+		if err != nil {
+			return err
+		}
+		if err = f(k, value); err != nil {
+			return err
+		}
+		pos = v.pos + int64(v.len)
+	}
+	return nil
+}
+
+// span is part of the file.
+//
+type span struct {
+	pos int64
+	len uint32
+}
+
+// record reads the key of the record at pos, and returns where its value is.
+//
+func (db *CDB) record(pos int64) ([]byte, span, error) {
+	var buf [8]byte
+	if err := db.read(buf[:], pos); err != nil {
+		return nil, span{}, err
+	}
+	klen := binary.LittleEndian.Uint32(buf[:])
+	dlen := binary.LittleEndian.Uint32(buf[4:])
+	key := make([]byte, klen)
+	if err := db.read(key, pos+8); err != nil {
+		return nil, span{}, err
+	}
+	return key, span{pos + 8 + int64(klen), dlen}, nil
+}
+
+// value reads the value at v.
+//
+func (db *CDB) value(v span) ([]byte, error) {
+	buf := make([]byte, v.len)
+	if err := db.read(buf, v.pos); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// read fills buf from pos. A short read means the file is corrupt.
+//
+func (db *CDB) read(buf []byte, pos int64) error {
+	_, err := db.r.ReadAt(buf, pos)
+	if err == io.EOF {
+		return ErrCorrupt
+	}
+	return err
+}
+
+// A Writer makes a cdb file. Records are written to a temporary file,
+// which replaces the named file when the Writer is closed, so readers
+// see either the old file or the complete new one.
+//
+type Writer struct {
+	path   string
+	f      *os.File
+	w      *bufio.Writer
+	pos    int64
+	tables [256][]slot
+	err    error
+}
+
+// slot is a hash table entry.
+//
+type slot struct {
+	hash uint32
+	pos  uint32
+}
+
+// Create returns a Writer that will replace path when it is closed.
+// The new file has mode perm.
+//
+func Create(path string, perm os.FileMode) (*Writer, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	if err = f.Chmod(perm); err == nil {
+		_, err = f.Seek(headerSize, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &Writer{
+		path: path,
+		f:    f,
+		w:    bufio.NewWriter(f),
+		pos:  headerSize,
+	}, nil
+}
+
+// Add adds a record. A key may be added more than once, and Get returns
+// the value added first.
+//
+func (w *Writer) Add(key, value []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	size := 8 + int64(len(key)) + int64(len(value))
+	if w.pos+size+int64(len(key)+1)*16 > math.MaxUint32 {
+		w.err = ErrTooBig
+		return w.err
+	}
+
+	var buf [8]byte
+	binary.LittleEndian.PutUint32(buf[:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(value)))
+	w.write(buf[:])
+	w.write(key)
+	w.write(value)
+
+	h := hash(key)
+	w.tables[h&0xff] = append(w.tables[h&0xff], slot{h, uint32(w.pos)})
+	w.pos += size
+	return w.err
+}
+
+func (w *Writer) write(buf []byte) {
+	if w.err == nil {
+		_, w.err = w.w.Write(buf)
+	}
+}
+
+// Chmod changes the mode of the new file.
+//
+func (w *Writer) Chmod(mode os.FileMode) error {
+	return w.f.Chmod(mode)
+}
+
+// Chown changes the owner and group of the new file.
+//
+func (w *Writer) Chown(uid, gid int) error {
+	return w.f.Chown(uid, gid)
+}
+
+// Abort throws away the new file, leaving the named file alone.
+//
+func (w *Writer) Abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// Close writes the hash tables and replaces the named file with the new
+// one. If anything went wrong, the named file is left alone.
+//
+func (w *Writer) Close() error {
+	defer os.Remove(w.f.Name()) // if it wasn't renamed
+
+	var header [headerSize]byte
+	for i, entries := range w.tables {
+		n := uint32(len(entries) * 2)
+		if w.pos+int64(n)*8 > math.MaxUint32 && w.err == nil {
+			w.err = ErrTooBig
+		}
+		binary.LittleEndian.PutUint32(header[i*8:], uint32(w.pos))
+		binary.LittleEndian.PutUint32(header[i*8+4:], n)
+		if n == 0 {
+			continue
+		}
+
+		table := make([]slot, n)
+		for _, e := range entries {
+			j := (e.hash >> 8) % n
+			for table[j].pos != 0 {
+				j = (j + 1) % n
+			}
+			table[j] = e
+		}
+		var buf [8]byte
+		for _, e := range table {
+			binary.LittleEndian.PutUint32(buf[:], e.hash)
+			binary.LittleEndian.PutUint32(buf[4:], e.pos)
+			w.write(buf[:])
+		}
+		w.pos += int64(n) * 8
+	}
+
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	if w.err == nil {
+		_, w.err = w.f.WriteAt(header[:], 0)
+	}
+	if w.err == nil {
+		w.err = w.f.Sync()
+	}
+	if err := w.f.Close(); w.err == nil {
+		w.err = err
+	}
+	if w.err != nil {
+		return w.err
+	}
+	return os.Rename(w.f.Name(), w.path)
+}
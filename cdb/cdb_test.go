@@ -0,0 +1,167 @@
+package cdb_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/wavemechanics/qdeliver/cdb"
+)
+
+func tempdir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "cdb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func write(t *testing.T, path string, records ...string) {
+	w, err := cdb.Create(path, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(records); i += 2 {
+		if err := w.Add([]byte(records[i]), []byte(records[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestFormat checks the file layout against the cdb format as cdbmake
+// writes it.
+func TestFormat(t *testing.T) {
+	dir, cleanup := tempdir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "one.cdb")
+	write(t, path, "a", "b")
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// header, record (8+1+1), hash table of 2 slots (16)
+	if len(buf) != 2048+10+16 {
+		t.Fatalf("file is %d bytes, want %d", len(buf), 2048+10+16)
+	}
+	// hash("a") is 177604, 0x2b5c4, so it goes in table 0xc4
+	if pos, n := binary.LittleEndian.Uint32(buf[0xc4*8:]), binary.LittleEndian.Uint32(buf[0xc4*8+4:]); pos != 2058 || n != 2 {
+		t.Fatalf("table 0xc4 at %d, %d slots, want 2058, 2", pos, n)
+	}
+	if record := string(buf[2048:2058]); record != "\x01\x00\x00\x00\x01\x00\x00\x00ab" {
+		t.Fatalf("record %q", record)
+	}
+	// slot (0x2b5c4>>8)%2 = 1 holds the hash and record position
+	if h, pos := binary.LittleEndian.Uint32(buf[2066:]), binary.LittleEndian.Uint32(buf[2070:]); h != 177604 || pos != 2048 {
+		t.Fatalf("slot 1: %d, %d, want 177604, 2048", h, pos)
+	}
+}
+
+func TestGet(t *testing.T) {
+	dir, cleanup := tempdir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "users.cdb")
+
+	var records []string
+	for i := 0; i < 1000; i++ {
+		records = append(records, fmt.Sprintf("owner%d@example.com", i), fmt.Sprint(i))
+	}
+	records = append(records, "owner1@example.com", "duplicate", "", "empty key")
+	write(t, path, records...)
+
+	db, err := cdb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var tests = []struct {
+		key   string
+		value string
+		err   error
+	}{
+		{"owner0@example.com", "0", nil},
+		{"owner1@example.com", "1", nil},
+		{"owner999@example.com", "999", nil},
+		{"", "empty key", nil},
+		{"owner1000@example.com", "", os.ErrNotExist},
+	}
+	for _, test := range tests {
+		value, err := db.Get([]byte(test.key))
+		if string(value) != test.value || !errors.Is(err, test.err) || (err == nil) != (test.err == nil) {
+			t.Errorf("Get(%q): %q, %v, want %q, %v", test.key, value, err, test.value, test.err)
+		}
+	}
+
+	var keys []string
+	err = db.ForEach(func(key, value []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil || len(keys) != 1002 || keys[0] != "owner0@example.com" || keys[1001] != "" {
+		t.Fatalf("ForEach: %d keys, %v", len(keys), err)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	dir, cleanup := tempdir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "users.cdb")
+	write(t, path, "key", "old")
+
+	old, err := cdb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+
+	w, err := cdb.Create(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Add([]byte("key"), []byte("abandoned"))
+	w.Abort()
+	write(t, path, "key", "new")
+
+	// a reader that opened the old file still sees it
+	if value, err := old.Get([]byte("key")); err != nil || string(value) != "old" {
+		t.Fatalf("old Get: %q, %v", value, err)
+	}
+	db, err := cdb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.Get([]byte("key")); err != nil || string(value) != "new" {
+		t.Fatalf("new Get: %q, %v", value, err)
+	}
+
+	infos, _ := ioutil.ReadDir(dir)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	if !reflect.DeepEqual(names, []string{"users.cdb"}) {
+		t.Fatalf("directory holds %q, want only users.cdb", names)
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	dir, cleanup := tempdir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "short.cdb")
+	if err := ioutil.WriteFile(path, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cdb.Open(path); !errors.Is(err, cdb.ErrCorrupt) {
+		t.Fatalf("Open of short file: %v, want %v", err, cdb.ErrCorrupt)
+	}
+}
@@ -0,0 +1,100 @@
+package deliver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/textproto"
+	"os"
+	"os/exec"
+
+	"github.com/wavemechanics/qdeliver/instruction"
+)
+
+// An Action carries out an instruction without running the handler script.
+// It returns a qmail-command exit status.
+//
+type Action func(ctx context.Context, d *Delivery, in instruction.Instruction) int
+
+// Forwarder is the program the forward action runs.
+//
+var Forwarder = "/var/qmail/bin/forward"
+
+// DefaultBounce is the bounce message used when bounce is given no argument.
+//
+const DefaultBounce = "This address no longer accepts mail."
+
+// actions holds the keywords handled natively. Any other keyword is passed
+// to the handler script.
+//
+var actions = map[string]Action{
+	"forward":       forward,
+	"bounce":        bounce,
+	"drop":          drop,
+	"match-subject": matchHeaders("Subject"),
+	"match-from":    matchHeaders("From"),
+	"match-to":      matchHeaders("To", "Cc"),
+	"match-header":  matchHeader,
+	"limit":         limit,
+	"expires":       expires,
+}
+
+// forward hands the message to qmail's forward(1) for the given addresses.
+//
+func forward(ctx context.Context, d *Delivery, in instruction.Instruction) int {
+	if len(in.Args) == 0 {
+		log.Println("forward: email addresses required")
+		return 111
+	}
+	cmd := exec.CommandContext(ctx, Forwarder, in.Args...)
+	cmd.Stdin = d.Message
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return status(cmd.Run())
+}
+
+// bounce rejects the message permanently. Anything written to stderr is
+// included in the bounce by qmail-local.
+//
+func bounce(ctx context.Context, d *Delivery, in instruction.Instruction) int {
+	text := DefaultBounce
+	if len(in.Args) > 0 && in.Args[0] != "" {
+		text = in.Args[0]
+	}
+	fmt.Fprintln(os.Stderr, text)
+	return 100
+}
+
+// drop accepts the message and ignores any remaining instructions.
+//
+func drop(ctx context.Context, d *Delivery, in instruction.Instruction) int {
+	fmt.Fprintln(os.Stderr, "dropping")
+	return 99
+}
+
+// readHeader returns the header of msg. A malformed or truncated header is
+// not an error; whatever could be read is returned, so a message with a
+// broken header simply doesn't match.
+//
+func readHeader(msg io.Reader) (textproto.MIMEHeader, error) {
+	hdr, err := textproto.NewReader(bufio.NewReader(msg)).ReadMIMEHeader()
+	if _, ok := err.(textproto.ProtocolError); ok || err == io.EOF {
+		err = nil
+	}
+	return hdr, err
+}
+
+// decodeHeader decodes RFC 2047 encoded-words in a header value.
+// Values that can't be decoded are returned as is.
+//
+func decodeHeader(value string) string {
+	var dec mime.WordDecoder
+	decoded, err := dec.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
@@ -0,0 +1,64 @@
+package deliver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/wavemechanics/qdeliver/instruction"
+)
+
+const message = "From: Sender <sender@example.com>\n" +
+	"To: me@example.com\n" +
+	"Cc: =?utf-8?q?J=C3=B6rg?= <jorg@example.org>\n" +
+	"List-Id: Some List <list.example.net>\n" +
+	"Subject: hello =?utf-8?q?w=C3=B6rld?=\n  folded\n" +
+	"\n" +
+	"body mentions code-word\n"
+
+// act runs the action for a single instruction line against msg.
+func act(t *testing.T, line, msg string) int {
+	list, _ := instruction.Parse(line)
+	if len(list) != 1 {
+		t.Fatalf("%q: %d instructions, want 1", line, len(list))
+	}
+	action, ok := actions[list[0].Keyword]
+	if !ok {
+		t.Fatalf("%q: no action", line)
+	}
+	return action(context.TODO(), &Delivery{Message: strings.NewReader(msg)}, list[0])
+}
+
+func TestActions(t *testing.T) {
+	Forwarder = "testdata/forward.sh"
+
+	var tests = []struct {
+		line   string
+		msg    string
+		status int
+	}{
+		{"forward", message, 111},
+		{"forward a@example.com b@example.com", message, 0},
+		{"forward a@example.com", message, 100},
+		{"bounce", message, 100},
+		{"bounce gone", message, 100},
+		{"drop", message, 99},
+		{"match-subject", message, 111},
+		{"match-subject hello", message, 0},
+		{"match-subject wörld", message, 0},   // encoded-word
+		{"match-subject folded", message, 0},  // continuation line
+		{"match-subject Hello", message, 100}, // case sensitive
+		{"match-subject code-word", message, 100},
+		{"match-subject code-word 'no code word'", message, 100},
+		{"match-subject hello", "", 100},
+		{"match-subject hello", "Subject: hello", 0}, // no body
+		{"match-subject hello", "bad header\nSubject: hello\n\n", 100},
+	}
+
+	for _, test := range tests {
+		status := act(t, test.line, test.msg)
+		if status != test.status {
+			t.Errorf("%q: %d, want %d", test.line, status, test.status)
+		}
+	}
+}
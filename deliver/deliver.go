@@ -2,26 +2,49 @@ package deliver
 
 import (
 	"context"
+	"errors"
+	"io"
 	"log"
 	"os"
 	"os/exec"
-	"strings"
 	"sync"
+	"time"
 
-	"github.com/wavemechanics/qdeliver/token"
+	"github.com/wavemechanics/qdeliver/instruction"
+	"github.com/wavemechanics/qdeliver/store"
 )
 
+// A Delivery is what an Action is told about the delivery in progress.
+//
+type Delivery struct {
+	Message io.Reader     // the message, positioned at its start
+	Storage store.Storage // storage holding the address file
+	Key     string        // key of the address file in Storage
+}
+
+// now returns the current time; tests replace it.
+//
+var now = time.Now
+
 // Deliver runs delivery instructions in an address file.
+// The whole file is parsed before anything is run, so a malformed line
+// defers delivery instead of leaving it half done.
+// s and key say where the instructions came from, and are used by
+// instructions that keep state next to the address file.
 //
-func Deliver(ctx context.Context, wg *sync.WaitGroup, handler, instructions string) int {
+func Deliver(ctx context.Context, wg *sync.WaitGroup, handler string, s store.Storage, key, instructions string) int {
 	defer wg.Done()
 
-	for _, line := range token.SplitFile(instructions) {
-		line = strings.TrimSpace(line)
-		if len(line) == 0 || strings.HasPrefix(line, "#") {
-			continue
+	list, err := instruction.Parse(instructions)
+	if bad := problems(err); len(bad) != 0 {
+		for _, e := range bad {
+			log.Printf("instruction line %v", e)
 		}
-		status := run(ctx, handler, line)
+		return 1
+	}
+
+	for _, in := range list {
+		status := run(ctx, handler, Delivery{Storage: s, Key: key}, in)
 		if status == 99 {
 			return 0
 		}
@@ -32,24 +55,40 @@ func Deliver(ctx context.Context, wg *sync.WaitGroup, handler, instructions stri
 	return 0
 }
 
-func run(ctx context.Context, handler, line string) int {
-	tokens, err := token.SplitLine(line)
-	if err != nil {
-		log.Printf("instruction line: %v", err)
-		return 1
-	}
-	if len(tokens) == 0 {
-		return 0
+// problems returns the parse errors that prevent delivery.
+// Unknown keywords aren't a problem because the handler may know them.
+//
+func problems(err error) instruction.ErrorList {
+	var bad instruction.ErrorList
+	errs, _ := err.(instruction.ErrorList)
+	for _, e := range errs {
+		if !errors.Is(e, instruction.ErrUnknownKeyword) {
+			bad = append(bad, e)
+		}
 	}
+	return bad
+}
+
+func run(ctx context.Context, handler string, d Delivery, in instruction.Instruction) int {
 	if _, err := os.Stdin.Seek(0, 0); err != nil {
 		log.Printf("rewind: %v", err)
 		return 1
 	}
-	cmd := exec.CommandContext(ctx, handler, tokens...)
+	if action, ok := actions[in.Keyword]; ok {
+		d.Message = os.Stdin
+		return action(ctx, &d, in)
+	}
+	cmd := exec.CommandContext(ctx, handler, append([]string{in.Keyword}, in.Args...)...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	err = cmd.Run()
+	return status(cmd.Run())
+}
+
+// status converts the result of running a command to a qmail-command
+// exit status.
+//
+func status(err error) int {
 	if err == nil {
 		return 0
 	}
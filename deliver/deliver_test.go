@@ -5,6 +5,8 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/wavemechanics/qdeliver/instruction"
 )
 
 func TestRun(t *testing.T) {
@@ -13,8 +15,6 @@ func TestRun(t *testing.T) {
 		timeout int
 		status  int
 	}{
-		{`"`, 0, 1}, // deliberate syntax error
-		{"", 0, 0},
 		{"/noexist", 0, -1}, // -1 means any non-zero; shells are different
 		{"false", 0, 1},
 		{"true", 0, 0},
@@ -35,7 +35,11 @@ func TestRun(t *testing.T) {
 		}
 		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(test.timeout)*time.Second)
 
-		status := run(ctx, "testdata/deliver.sh", test.line)
+		list, _ := instruction.Parse(test.line)
+		if len(list) != 1 {
+			t.Fatalf("%q: %d instructions, want 1", test.line, len(list))
+		}
+		status := run(ctx, "testdata/deliver.sh", Delivery{}, list[0])
 		if test.status == -1 {
 			if status == 0 {
 				t.Errorf("%q: exit 0, wanted non-zero", test.line)
@@ -68,6 +72,9 @@ func TestDeliver(t *testing.T) {
 		{"true\n#\nfalse\n", 0, 1},            // test skips comments
 		{"true\n\nfalse\n", 0, 1},             // skips blank lines
 		{"./testdata/sleep.sh", 2, -1},        // -1 means any non-zero; shells are different
+		{`"`, 0, 1},                           // deliberate syntax error
+		{"true\ndrop x\n", 0, 1},              // wrong number of arguments
+		{"./testdata/exit99.sh\n'", 0, 1},     // syntax errors are found before running anything
 	}
 
 	for _, test := range tests {
@@ -78,7 +85,7 @@ func TestDeliver(t *testing.T) {
 
 		var wg sync.WaitGroup
 		wg.Add(1)
-		status := Deliver(ctx, &wg, "testdata/deliver.sh", test.instructions)
+		status := Deliver(ctx, &wg, "testdata/deliver.sh", nil, "", test.instructions)
 		wg.Wait()
 
 		if test.status == -1 {
@@ -0,0 +1,42 @@
+package deliver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/wavemechanics/qdeliver/instruction"
+)
+
+// DefaultExpired is the bounce message used when expires is given no message.
+//
+const DefaultExpired = "This address has expired."
+
+// expires bounces the message if the date in Args[0] has passed.
+// Args[1], if given, is the bounce message.
+//
+// A relative date should have been made absolute when the address file was
+// created from default.txt. If it wasn't, there is nothing to count from,
+// so it is logged and ignored.
+//
+func expires(ctx context.Context, d *Delivery, in instruction.Instruction) int {
+	t, rel, err := instruction.ParseExpiry(in.Args[0])
+	if err != nil {
+		log.Printf("%s: %v", in.Keyword, err)
+		return 111
+	}
+	if t.IsZero() {
+		log.Printf("%s: ignoring relative date %s (%v)", in.Keyword, in.Args[0], rel)
+		return 0
+	}
+	if now().Before(t) {
+		return 0
+	}
+	text := DefaultExpired
+	if len(in.Args) > 1 {
+		text = in.Args[1]
+	}
+	fmt.Fprintln(os.Stderr, text)
+	return 100
+}
@@ -0,0 +1,38 @@
+package deliver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/wavemechanics/qdeliver/instruction"
+)
+
+func TestExpires(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Date(2026, 10, 18, 23, 59, 0, 0, time.UTC) }
+
+	var tests = []struct {
+		line   string
+		status int
+	}{
+		{"expires 2026-10-18", 0}, // still the 18th
+		{"expires 2026-10-17", 100},
+		{"expires 2026-10-17 'Conference is over'", 100},
+		{"expires 2026-10-19T00:00:00Z", 0},
+		{"expires 2026-10-18T23:58:00Z", 100},
+		{"expires 2026-10-19T01:00:00+02:00", 100}, // 23:00 UTC
+		{"expires +30d", 0},                        // unresolved relative dates are ignored
+	}
+
+	for _, test := range tests {
+		list, err := instruction.Parse(test.line)
+		if err != nil {
+			t.Fatalf("%q: %v", test.line, err)
+		}
+		status := expires(context.TODO(), &Delivery{}, list[0])
+		if status != test.status {
+			t.Errorf("%q: %d, want %d", test.line, status, test.status)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package deliver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/wavemechanics/qdeliver/instruction"
+	"github.com/wavemechanics/qdeliver/lookup"
+	"github.com/wavemechanics/qdeliver/store"
+)
+
+// CounterSuffix is added to the key of an address file to make the key
+// the limit instruction keeps its counter under. No address can have such
+// a key; see lookup.CounterSuffix.
+//
+const CounterSuffix = lookup.CounterSuffix
+
+// Default messages for a message over the limit.
+//
+const (
+	DefaultLimitDefer  = "Too much mail for this address; try again later."
+	DefaultLimitBounce = "This address has received too much mail."
+)
+
+// counter is what the limit instruction keeps in storage.
+//
+type counter struct {
+	Start time.Time `json:"start"` // when the current period started
+	Count int       `json:"count"` // messages so far in the current period
+}
+
+// limit defers or bounces the message if Args[0], such as "20/day", messages
+// have already reached this instruction in the current period. Periods are
+// counted from fixed points in UTC, so a day runs from midnight to midnight.
+// Args[1] is "defer" (the default) or "bounce", and Args[2], if given, is
+// the message to use instead of the default.
+//
+// If the counter can't be read or written, the message is let through.
+// A counter holding anything else, such as instructions, is started again.
+// Where the storage supports it, the counter is updated with a conditional
+// write, so deliveries running at the same time all get counted.
+//
+func limit(ctx context.Context, d *Delivery, in instruction.Instruction) int {
+	n, period, err := instruction.ParseLimit(in.Args[0])
+	if err != nil {
+		log.Printf("%s: %v", in.Keyword, err)
+		return 111
+	}
+	if d.Storage == nil || d.Key == "" {
+		log.Printf("%s: no storage for counter", in.Keyword)
+		return 111
+	}
+	key := d.Key + CounterSuffix
+	start := now().UTC().Truncate(period)
+
+	for attempt := 1; ; attempt++ {
+		c, save, err := loadCounter(ctx, d.Storage, key)
+		if err != nil {
+			log.Printf("%s: %s: %v; not counting", in.Keyword, key, err)
+			return 0
+		}
+		if !c.Start.Equal(start) {
+			c = counter{Start: start}
+		}
+
+		if c.Count >= n {
+			status, text := 111, DefaultLimitDefer
+			if len(in.Args) > 1 && in.Args[1] == "bounce" {
+				status, text = 100, DefaultLimitBounce
+			}
+			if len(in.Args) > 2 {
+				text = in.Args[2]
+			}
+			fmt.Fprintln(os.Stderr, text)
+			return status
+		}
+
+		c.Count++
+		buf, err := json.Marshal(c)
+		if err == nil {
+			err = save(string(buf))
+		}
+		if (errors.Is(err, store.ErrConflict) || errors.Is(err, os.ErrExist)) && attempt < counterAttempts {
+			continue // another delivery counted first; count again
+		}
+		if err != nil {
+			log.Printf("%s: %s: %v", in.Keyword, key, err)
+		}
+		return 0
+	}
+}
+
+// counterAttempts is how many times limit tries to update a counter that
+// other deliveries are updating at the same time.
+//
+const counterAttempts = 5
+
+// loadCounter reads the counter stored under key, and returns a function
+// that saves a new value for it. If s is a store.Versioner, the save fails
+// if another delivery has changed the counter since it was read.
+// A counter that doesn't exist yet is returned as zero, and so is one that
+// can't be decoded, which the save then overwrites.
+//
+func loadCounter(ctx context.Context, s store.Storage, key string) (c counter, save func(value string) error, err error) {
+	var value string
+	save = func(value string) error { return s.Set(ctx, key, value) }
+
+	if v, ok := s.(store.Versioner); ok {
+		var rev store.Revision
+		value, rev, err = v.GetVersion(ctx, key)
+		if err == nil {
+			save = func(value string) error { return v.SetIf(ctx, key, value, rev) }
+		} else if errors.Is(err, os.ErrNotExist) {
+			save = func(value string) error { return store.Create(ctx, s, key, value) }
+		}
+	} else {
+		value, err = s.Get(ctx, key)
+	}
+
+	if errors.Is(err, os.ErrNotExist) {
+		return counter{}, save, nil
+	}
+	if err != nil {
+		return counter{}, save, err
+	}
+	if err = json.Unmarshal([]byte(value), &c); err != nil {
+		log.Printf("limit: %s: %v; starting again", key, err)
+		return counter{}, save, nil
+	}
+	return c, save, nil
+}
@@ -0,0 +1,193 @@
+package deliver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wavemechanics/qdeliver/instruction"
+	"github.com/wavemechanics/qdeliver/store"
+	"github.com/wavemechanics/qdeliver/store/cache"
+	"github.com/wavemechanics/qdeliver/store/fallback"
+	"github.com/wavemechanics/qdeliver/store/mem"
+)
+
+func TestLimit(t *testing.T) {
+	defer func() { now = time.Now }()
+	day := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		line   string
+		at     time.Duration // time since day
+		status int
+	}{
+		{"limit 2/day", 0, 0},
+		{"limit 2/day", time.Hour, 0},
+		{"limit 2/day", 2 * time.Hour, 111},
+		{"limit 2/day bounce", 3 * time.Hour, 100},
+		{"limit 2/day bounce 'go away'", 4 * time.Hour, 100},
+		{"limit 3/day", 5 * time.Hour, 0}, // raised limit
+		{"limit 3/day", 6 * time.Hour, 111},
+		{"limit 3/day", 15 * time.Hour, 0}, // next day
+		{"limit 0/hour bounce", 16 * time.Hour, 100},
+	}
+
+	var s mem.Storage
+	for _, test := range tests {
+		list, err := instruction.Parse(test.line)
+		if err != nil {
+			t.Fatalf("%q: %v", test.line, err)
+		}
+		now = func() time.Time { return day.Add(test.at) }
+
+		d := &Delivery{
+			Message: strings.NewReader(message),
+			Storage: &s,
+			Key:     "me-leaked",
+		}
+		status := limit(context.TODO(), d, list[0])
+		if status != test.status {
+			t.Errorf("%q at %v: %d, want %d", test.line, test.at, status, test.status)
+		}
+	}
+
+	value, err := s.Get(context.TODO(), "me-leaked"+CounterSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"start":"2026-10-19T00:00:00Z","count":1}`
+	if value != want {
+		t.Fatalf("counter: %s, want %s", value, want)
+	}
+
+	list, _ := instruction.Parse("limit 1/day")
+	if status := limit(context.TODO(), &Delivery{}, list[0]); status != 111 {
+		t.Fatalf("no storage: %d, want 111", status)
+	}
+}
+
+// racer is a Storage in which another delivery bumps the counter just after
+// it is first read.
+type racer struct {
+	*mem.Storage
+	raced bool
+}
+
+func (r *racer) GetVersion(ctx context.Context, key string) (string, store.Revision, error) {
+	value, rev, err := r.Storage.GetVersion(ctx, key)
+	if !r.raced {
+		r.raced = true
+		r.Storage.Set(ctx, key, `{"start":"2026-10-18T00:00:00Z","count":1}`)
+	}
+	return value, rev, err
+}
+
+func TestLimitConflict(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC) }
+
+	s := &racer{Storage: &mem.Storage{}}
+	key := "me-leaked" + CounterSuffix
+	list, _ := instruction.Parse("limit 2/day")
+	d := &Delivery{Storage: s, Key: "me-leaked"}
+
+	// the first attempt to create the counter loses, so it counts again
+	if status := limit(context.TODO(), d, list[0]); status != 0 {
+		t.Fatalf("first: %d, want 0", status)
+	}
+	value, _ := s.Get(context.TODO(), key)
+	if want := `{"start":"2026-10-18T00:00:00Z","count":2}`; value != want {
+		t.Fatalf("counter: %s, want %s", value, want)
+	}
+
+	if status := limit(context.TODO(), d, list[0]); status != 111 {
+		t.Fatalf("second: %d, want 111", status)
+	}
+}
+
+// TestLimitBadCounter tests that a counter that can't be decoded, such as
+// instructions copied over it, is started again rather than ignored
+func TestLimitBadCounter(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC) }
+
+	for _, versioned := range []bool{true, false} {
+		m := &mem.Storage{}
+		var s store.Storage = m
+		if !versioned {
+			s = plain{m}
+		}
+		key := "joe-x" + CounterSuffix
+		m.Set(context.TODO(), key, "limit 1/day bounce\n")
+
+		list, _ := instruction.Parse("limit 1/day bounce")
+		d := &Delivery{Storage: s, Key: "joe-x"}
+		if status := limit(context.TODO(), d, list[0]); status != 0 {
+			t.Errorf("versioned %v: first: %d, want 0", versioned, status)
+		}
+		if status := limit(context.TODO(), d, list[0]); status != 100 {
+			t.Errorf("versioned %v: second: %d, want 100", versioned, status)
+		}
+		value, _ := m.Get(context.TODO(), key)
+		if want := `{"start":"2026-10-18T00:00:00Z","count":1}`; value != want {
+			t.Errorf("versioned %v: counter: %s, want %s", versioned, value, want)
+		}
+	}
+}
+
+// plain hides all but the Storage methods of a Storage.
+type plain struct {
+	store.Storage
+}
+
+// TestLimitWrapped tests that counters are still updated with conditional
+// writes through the cache and fallback wrappers
+func TestLimitWrapped(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC) }
+
+	dir, err := ioutil.TempDir("", "TestLimitWrapped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tests = []struct {
+		name string
+		wrap func(s store.Storage) (store.Storage, error)
+	}{
+		{"cache", func(s store.Storage) (store.Storage, error) {
+			return cache.New(dir, s)
+		}},
+		{"fallback", func(s store.Storage) (store.Storage, error) {
+			return fallback.New([]store.Storage{s, &mem.Storage{}}, false), nil
+		}},
+	}
+	for _, test := range tests {
+		r := &racer{Storage: &mem.Storage{}}
+		s, err := test.wrap(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := s.(store.Versioner); !ok {
+			t.Fatalf("%s: not a store.Versioner", test.name)
+		}
+
+		// the first attempt to create the counter loses, so it counts again
+		list, _ := instruction.Parse("limit 2/day")
+		d := &Delivery{Storage: s, Key: "me-leaked"}
+		if status := limit(context.TODO(), d, list[0]); status != 0 {
+			t.Fatalf("%s: first: %d, want 0", test.name, status)
+		}
+		value, _ := r.Get(context.TODO(), "me-leaked"+CounterSuffix)
+		if want := `{"start":"2026-10-18T00:00:00Z","count":2}`; value != want {
+			t.Errorf("%s: counter: %s, want %s", test.name, value, want)
+		}
+		if status := limit(context.TODO(), d, list[0]); status != 111 {
+			t.Errorf("%s: second: %d, want 111", test.name, status)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package deliver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/wavemechanics/qdeliver/instruction"
+)
+
+// matchHeaders returns an action that bounces the message unless Args[0]
+// matches one of the named headers. Args[1], if given, is included in the
+// bounce.
+//
+func matchHeaders(names ...string) Action {
+	return func(ctx context.Context, d *Delivery, in instruction.Instruction) int {
+		if len(in.Args) == 0 {
+			log.Printf("%s: pattern required", in.Keyword)
+			return 111
+		}
+		return match(d.Message, in, names, in.Args[0], in.Args[1:])
+	}
+}
+
+// matchHeader bounces the message unless Args[1] matches the header named
+// by Args[0]. Args[2], if given, is included in the bounce.
+//
+func matchHeader(ctx context.Context, d *Delivery, in instruction.Instruction) int {
+	if len(in.Args) < 2 {
+		log.Printf("%s: header and pattern required", in.Keyword)
+		return 111
+	}
+	return match(d.Message, in, in.Args[:1], in.Args[1], in.Args[2:])
+}
+
+// match returns 0 if pattern matches any value of the named headers in msg.
+// Otherwise it prints the optional bounce message and returns 100.
+//
+// By default pattern is a case sensitive substring. The i flag makes it
+// case insensitive, and the r flag makes it a regular expression.
+// Encoded-words in header values are decoded before matching.
+//
+func match(msg io.Reader, in instruction.Instruction, names []string, pattern string, message []string) int {
+	matches, err := matcher(in, pattern)
+	if err != nil {
+		log.Printf("%s: %v", in.Keyword, err)
+		return 111
+	}
+	hdr, err := readHeader(msg)
+	if err != nil {
+		log.Printf("%s: %v", in.Keyword, err)
+		return 111
+	}
+	for _, name := range names {
+		for _, value := range hdr[textproto.CanonicalMIMEHeaderKey(name)] {
+			if matches(decodeHeader(value)) {
+				return 0
+			}
+		}
+	}
+	if len(message) > 0 {
+		fmt.Fprintln(os.Stderr, message[0])
+	}
+	return 100
+}
+
+// matcher returns a function reporting whether a header value matches
+// pattern, taking the instruction's flags into account.
+//
+func matcher(in instruction.Instruction, pattern string) (func(value string) bool, error) {
+	if in.HasFlag('r') {
+		if in.HasFlag('i') {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+	if in.HasFlag('i') {
+		pattern = strings.ToLower(pattern)
+		return func(value string) bool {
+			return strings.Contains(strings.ToLower(value), pattern)
+		}, nil
+	}
+	return func(value string) bool {
+		return strings.Contains(value, pattern)
+	}, nil
+}
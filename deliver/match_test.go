@@ -0,0 +1,42 @@
+package deliver
+
+import (
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	var tests = []struct {
+		line   string
+		status int
+	}{
+		{"match-subject -i HELLO", 0},
+		{"match-subject -r '^hello w.rld'", 0},
+		{"match-subject -r '^world'", 100},
+		{"match-subject -r -i '^HELLO'", 0},
+		{"match-subject -ri '^HELLO'", 0},
+		{"match-subject -- -i", 100},        // -- ends flags
+		{"match-subject -unsubscribe", 100}, // not a flag, so the pattern
+		{"match-from sender@example.com", 0},
+		{"match-from Sender", 0},
+		{"match-from me@example.com", 100},
+		{"match-to me@example.com", 0},
+		{"match-to jorg@example.org", 0}, // Cc
+		{"match-to Jörg", 0},             // decoded Cc
+		{"match-to -i JORG@", 0},
+		{"match-to sender@example.com 'not for you'", 100},
+		{"match-header List-Id list.example.net", 0},
+		{"match-header list-id list.example.net", 0}, // header names are case insensitive
+		{"match-header -r List-Id '<list\\.example\\.(net|org)>$'", 0},
+		{"match-header List-Id other.example.net", 100},
+		{"match-header X-Missing anything", 100},
+		{"match-header -r Subject '('", 111}, // bad regexp
+		{"match-header Subject", 111},
+	}
+
+	for _, test := range tests {
+		status := act(t, test.line, message)
+		if status != test.status {
+			t.Errorf("%q: %d, want %d", test.line, status, test.status)
+		}
+	}
+}
@@ -0,0 +1,6 @@
+#!/bin/sh
+
+# fake qmail forward: succeed only if the addresses and message arrive
+test "$*" = "a@example.com b@example.com" || exit 100
+grep -q '^Subject: hello' || exit 111
+exit 0
@@ -0,0 +1,327 @@
+package instruction
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wavemechanics/etype"
+	"github.com/wavemechanics/qdeliver/token"
+)
+
+const (
+	ErrUnknownKeyword = etype.Sentinel("unknown keyword")
+	ErrTooFewArgs     = etype.Sentinel("too few arguments")
+	ErrTooManyArgs    = etype.Sentinel("too many arguments")
+	ErrBadArg         = etype.Sentinel("bad argument")
+)
+
+// A Spec describes the arguments accepted by a keyword.
+// Max < 0 means there is no upper limit.
+//
+// Flags lists the single letter flags, such as "-i", that may come before
+// the arguments. A "--" argument ends the flags.
+// Validate, if not nil, checks the arguments further once their number is
+// known to be right.
+//
+type Spec struct {
+	Min      int
+	Max      int
+	Flags    string
+	Validate func(in *Instruction) error
+}
+
+// Keywords lists the keywords qdeliver knows about.
+//
+var Keywords = map[string]Spec{
+	"forward":       {Min: 1, Max: -1},
+	"bounce":        {Min: 0, Max: 1},
+	"drop":          {Min: 0, Max: 0},
+	"match-subject": {Min: 1, Max: 2, Flags: "ir", Validate: pattern(0)},
+	"match-from":    {Min: 1, Max: 2, Flags: "ir", Validate: pattern(0)},
+	"match-to":      {Min: 1, Max: 2, Flags: "ir", Validate: pattern(0)},
+	"match-header":  {Min: 2, Max: 3, Flags: "ir", Validate: pattern(1)},
+	"limit":         {Min: 1, Max: 3, Validate: limit},
+	"expires":       {Min: 1, Max: 2, Validate: expires},
+}
+
+// An Instruction is a single line from an address file.
+// Flags holds the letters of any flags given, in order.
+// Line and Col give the position of the keyword, counting from 1.
+//
+type Instruction struct {
+	Keyword string
+	Flags   string
+	Args    []string
+	Line    int
+	Col     int
+}
+
+// HasFlag reports whether flag was given.
+//
+func (in *Instruction) HasFlag(flag byte) bool {
+	return strings.IndexByte(in.Flags, flag) >= 0
+}
+
+// pattern returns a Validate function that checks that Args[i] compiles if
+// it is a regular expression.
+//
+func pattern(i int) func(in *Instruction) error {
+	return func(in *Instruction) error {
+		if !in.HasFlag('r') {
+			return nil
+		}
+		if _, err := regexp.Compile(in.Args[i]); err != nil {
+			return fmt.Errorf("%s: %w: %v", in.Keyword, ErrBadArg, err)
+		}
+		return nil
+	}
+}
+
+// An Error is a problem found at a position in an address file.
+//
+type Error struct {
+	Line int
+	Col  int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d:%d: %v", e.Line, e.Col, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrorList is the list of problems found by Parse, in file order.
+//
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	return fmt.Sprintf("%v (and %d more errors)", l[0], len(l)-1)
+}
+
+// Parse parses the contents of an address file.
+// Blank lines and comments are skipped.
+//
+// Every line that can be tokenized is returned, even if its keyword is
+// unknown or it has the wrong number of arguments, so callers can decide
+// which problems matter to them. If there are any problems, err is an
+// ErrorList describing all of them.
+//
+func Parse(contents string) ([]Instruction, error) {
+	var list []Instruction
+	var errs ErrorList
+
+	for i, line := range token.SplitFile(contents) {
+		tokens, col, err := token.Scan(line)
+		if err != nil {
+			errs = append(errs, &Error{Line: i + 1, Col: col, Err: err})
+			continue
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+		in := Instruction{
+			Keyword: tokens[0].Text,
+			Line:    i + 1,
+			Col:     tokens[0].Col,
+		}
+		in.setArgs(tokens[1:])
+		if err := in.Check(); err != nil {
+			errs = append(errs, &Error{Line: in.Line, Col: in.Col, Err: err})
+		}
+		list = append(list, in)
+	}
+
+	if len(errs) != 0 {
+		return list, errs
+	}
+	return list, nil
+}
+
+// setArgs splits tokens into flags and arguments.
+// Only keywords known to accept flags have them, and they can be combined,
+// as in "-ri". The first token made of anything but those flags starts the
+// arguments, so a pattern such as "-unsubscribe" needs no "--" before it.
+//
+func (in *Instruction) setArgs(tokens []token.Token) {
+	spec := Keywords[in.Keyword]
+	for len(tokens) > 0 && spec.Flags != "" {
+		flag := tokens[0].Text
+		if flag == "--" {
+			tokens = tokens[1:]
+			break
+		}
+		if !isFlags(flag, spec.Flags) {
+			break
+		}
+		in.Flags += flag[1:]
+		tokens = tokens[1:]
+	}
+	for _, tok := range tokens {
+		in.Args = append(in.Args, tok.Text)
+	}
+}
+
+// isFlags reports whether tok is a dash followed only by letters in flags.
+//
+func isFlags(tok, flags string) bool {
+	if len(tok) < 2 || tok[0] != '-' {
+		return false
+	}
+	for i := 1; i < len(tok); i++ {
+		if strings.IndexByte(flags, tok[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Check reports whether in has a known keyword, the right number of
+// arguments for it, and arguments that make sense.
+//
+func (in *Instruction) Check() error {
+	spec, ok := Keywords[in.Keyword]
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownKeyword, in.Keyword)
+	}
+	if len(in.Args) < spec.Min {
+		return fmt.Errorf("%s: %w (want at least %d)", in.Keyword, ErrTooFewArgs, spec.Min)
+	}
+	if spec.Max >= 0 && len(in.Args) > spec.Max {
+		return fmt.Errorf("%s: %w (want at most %d)", in.Keyword, ErrTooManyArgs, spec.Max)
+	}
+	if spec.Validate != nil {
+		return spec.Validate(in)
+	}
+	return nil
+}
+
+// periods are the named periods a limit can be counted over.
+//
+var periods = map[string]time.Duration{
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
+}
+
+// ParseLimit parses the rate given to a limit instruction, such as "20/day".
+// The period is minute, hour, day or week, or a duration such as "12h".
+//
+func ParseLimit(rate string) (n int, period time.Duration, err error) {
+	parts := strings.SplitN(rate, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("%w: %q is not count/period", ErrBadArg, rate)
+	}
+	n, err = strconv.Atoi(parts[0])
+	if err != nil || n < 0 {
+		return 0, 0, fmt.Errorf("%w: %q is not a count", ErrBadArg, parts[0])
+	}
+	period, ok := periods[parts[1]]
+	if !ok {
+		period, err = time.ParseDuration(parts[1])
+		if err != nil || period <= 0 {
+			return 0, 0, fmt.Errorf("%w: %q is not a period", ErrBadArg, parts[1])
+		}
+	}
+	return n, period, nil
+}
+
+// limit checks the arguments of a limit instruction.
+//
+func limit(in *Instruction) error {
+	if _, _, err := ParseLimit(in.Args[0]); err != nil {
+		return fmt.Errorf("%s: %w", in.Keyword, err)
+	}
+	if len(in.Args) > 1 && in.Args[1] != "defer" && in.Args[1] != "bounce" {
+		return fmt.Errorf("%s: %w: %q is not defer or bounce", in.Keyword, ErrBadArg, in.Args[1])
+	}
+	return nil
+}
+
+// ParseExpiry parses the date given to an expires instruction.
+//
+// An absolute date is either a day such as 2006-01-02, which expires at the
+// end of that day in UTC, or an RFC 3339 time; t is when it expires.
+// A relative date is "+" followed by a number of days, weeks or hours, such
+// as +30d, +2w or +12h; rel is how long that is, and t is the zero time.
+//
+func ParseExpiry(date string) (t time.Time, rel time.Duration, err error) {
+	if strings.HasPrefix(date, "+") && len(date) > 2 {
+		n, err := strconv.Atoi(date[1 : len(date)-1])
+		if err == nil && n >= 0 {
+			switch date[len(date)-1] {
+			case 'h':
+				return time.Time{}, time.Duration(n) * time.Hour, nil
+			case 'd':
+				return time.Time{}, time.Duration(n) * 24 * time.Hour, nil
+			case 'w':
+				return time.Time{}, time.Duration(n) * 7 * 24 * time.Hour, nil
+			}
+		}
+		return time.Time{}, 0, fmt.Errorf("%w: %q is not +days, +weeks or +hours", ErrBadArg, date)
+	}
+	if t, err := time.Parse("2006-01-02", date); err == nil {
+		return t.AddDate(0, 0, 1), 0, nil
+	}
+	if t, err := time.Parse(time.RFC3339, date); err == nil {
+		return t, 0, nil
+	}
+	return time.Time{}, 0, fmt.Errorf("%w: %q is not a date", ErrBadArg, date)
+}
+
+// expires checks the arguments of an expires instruction.
+//
+func expires(in *Instruction) error {
+	if _, _, err := ParseExpiry(in.Args[0]); err != nil {
+		return fmt.Errorf("%s: %w", in.Keyword, err)
+	}
+	return nil
+}
+
+// ResolveExpiry replaces relative dates in the expires instructions in
+// contents with absolute dates, counting from now. Relative days and weeks
+// become a day, and relative hours become an RFC 3339 time.
+// Only unquoted dates are replaced, and if nothing is replaced, contents
+// is returned unchanged.
+//
+func ResolveExpiry(contents string, now time.Time) string {
+	lines := token.SplitFile(contents)
+	changed := false
+	for i, line := range lines {
+		tokens, _, err := token.Scan(line)
+		if err != nil || len(tokens) < 2 || tokens[0].Text != "expires" {
+			continue
+		}
+		_, rel, err := ParseExpiry(tokens[1].Text)
+		if err != nil || rel == 0 && !strings.HasPrefix(tokens[1].Text, "+") {
+			continue
+		}
+		start := len(string([]rune(line)[:tokens[1].Col-1]))
+		if !strings.HasPrefix(line[start:], tokens[1].Text) {
+			continue // quoted or escaped
+		}
+		t := now.UTC().Add(rel)
+		date := t.Format(time.RFC3339)
+		if rel%(24*time.Hour) == 0 {
+			date = t.Format("2006-01-02")
+		}
+		lines[i] = line[:start] + date + line[start+len(tokens[1].Text):]
+		changed = true
+	}
+	if !changed {
+		return contents
+	}
+	return strings.Join(lines, "\n")
+}
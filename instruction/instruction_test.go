@@ -0,0 +1,181 @@
+package instruction_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wavemechanics/qdeliver/instruction"
+	"github.com/wavemechanics/qdeliver/token"
+)
+
+func TestParse(t *testing.T) {
+	contents := "# comment\n" +
+		"forward a@example.com 'b@example.com'\n" +
+		"\n" +
+		"  bounce \"gone away\"\n" +
+		"drop\n"
+
+	want := []instruction.Instruction{
+		{Keyword: "forward", Args: []string{"a@example.com", "b@example.com"}, Line: 2, Col: 1},
+		{Keyword: "bounce", Args: []string{"gone away"}, Line: 4, Col: 3},
+		{Keyword: "drop", Line: 5, Col: 1},
+	}
+
+	got, err := instruction.Parse(contents)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Parse: %+v, want %+v", got, want)
+	}
+}
+
+func TestFlags(t *testing.T) {
+	var tests = []struct {
+		line  string
+		flags string
+		args  []string
+	}{
+		{"match-to me", "", []string{"me"}},
+		{"match-to -i me", "i", []string{"me"}},
+		{"match-to -r -i me msg", "ri", []string{"me", "msg"}},
+		{"match-to -- -i", "", []string{"-i"}},
+		{"match-to -i -- -r", "i", []string{"-r"}},
+		{"bounce -i", "", []string{"-i"}}, // bounce has no flags
+		{"match-subject -unsubscribe", "", []string{"-unsubscribe"}},
+		{"match-subject -i -unsubscribe", "i", []string{"-unsubscribe"}},
+		{"match-subject -ri x", "ri", []string{"x"}},
+		{"match-subject -rix x", "", []string{"-rix", "x"}},
+		{"match-from -x me", "", []string{"-x", "me"}}, // not a flag, so the pattern
+	}
+
+	for _, test := range tests {
+		list, err := instruction.Parse(test.line)
+		if err != nil || len(list) != 1 {
+			t.Errorf("%q: %v", test.line, err)
+			continue
+		}
+		if list[0].Flags != test.flags || !reflect.DeepEqual(list[0].Args, test.args) {
+			t.Errorf("%q: flags %q args %q, want %q %q", test.line, list[0].Flags, list[0].Args, test.flags, test.args)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	var tests = []struct {
+		contents string
+		n        int   // number of instructions returned
+		line     int   // position of first error
+		col      int   //
+		err      error // first error
+	}{
+		{"forward", 1, 1, 1, instruction.ErrTooFewArgs},
+		{"drop now", 1, 1, 1, instruction.ErrTooManyArgs},
+		{"bounce a b", 1, 1, 1, instruction.ErrTooManyArgs},
+		{"drop\n  frward x", 2, 2, 3, instruction.ErrUnknownKeyword},
+		{"drop\nbounce 'gone", 1, 2, 8, token.ErrSquote},
+		{"bounce \"gone\nforwrd x", 1, 1, 8, token.ErrDquote},
+		{"match-header -i Subject", 1, 1, 1, instruction.ErrTooFewArgs},
+		{"match-to -r '['", 1, 1, 1, instruction.ErrBadArg},
+		{"limit 20", 1, 1, 1, instruction.ErrBadArg},
+		{"limit 20/fortnight", 1, 1, 1, instruction.ErrBadArg},
+		{"limit x/day", 1, 1, 1, instruction.ErrBadArg},
+		{"limit 20/day reject", 1, 1, 1, instruction.ErrBadArg},
+		{"expires tomorrow", 1, 1, 1, instruction.ErrBadArg},
+		{"expires +30", 1, 1, 1, instruction.ErrBadArg},
+		{"expires +30y", 1, 1, 1, instruction.ErrBadArg},
+		{"expires 2026-13-01", 1, 1, 1, instruction.ErrBadArg},
+	}
+
+	for _, test := range tests {
+		list, err := instruction.Parse(test.contents)
+		if len(list) != test.n {
+			t.Errorf("%q: %d instructions, want %d", test.contents, len(list), test.n)
+		}
+		var errs instruction.ErrorList
+		if !errors.As(err, &errs) {
+			t.Errorf("%q: %v, want ErrorList", test.contents, err)
+			continue
+		}
+		first := errs[0]
+		if first.Line != test.line || first.Col != test.col {
+			t.Errorf("%q: error at %d:%d, want %d:%d", test.contents, first.Line, first.Col, test.line, test.col)
+		}
+		if !errors.Is(first, test.err) {
+			t.Errorf("%q: %v, want %v", test.contents, first, test.err)
+		}
+	}
+}
+
+func TestErrorList(t *testing.T) {
+	_, err := instruction.Parse("bounce 'a\nforwrd\ndrop x\n")
+	errs, ok := err.(instruction.ErrorList)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("Parse: %v, want 3 errors", err)
+	}
+	want := `1:8: unterminated single quote (and 2 more errors)`
+	if err.Error() != want {
+		t.Fatalf("Error: %q, want %q", err.Error(), want)
+	}
+	want = `2:1: unknown keyword "forwrd"`
+	if errs[1].Error() != want {
+		t.Fatalf("Error: %q, want %q", errs[1].Error(), want)
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	var tests = []struct {
+		rate   string
+		ok     bool
+		n      int
+		period time.Duration
+	}{
+		{"20/day", true, 20, 24 * time.Hour},
+		{"0/hour", true, 0, time.Hour},
+		{"5/minute", true, 5, time.Minute},
+		{"100/week", true, 100, 7 * 24 * time.Hour},
+		{"3/12h", true, 3, 12 * time.Hour},
+		{"3/0s", false, 0, 0},
+		{"-1/day", false, 0, 0},
+		{"day", false, 0, 0},
+		{"/day", false, 0, 0},
+	}
+
+	for _, test := range tests {
+		n, period, err := instruction.ParseLimit(test.rate)
+		if test.ok != (err == nil) {
+			t.Errorf("%q: %v, want ok=%v", test.rate, err, test.ok)
+			continue
+		}
+		if n != test.n || period != test.period {
+			t.Errorf("%q: %d/%v, want %d/%v", test.rate, n, period, test.n, test.period)
+		}
+	}
+}
+
+func TestResolveExpiry(t *testing.T) {
+	now := time.Date(2026, 10, 18, 15, 4, 5, 0, time.FixedZone("EST", -5*60*60))
+
+	var tests = []struct {
+		contents string
+		want     string
+	}{
+		{"drop\n", "drop\n"},
+		{"expires 2026-12-01\n", "expires 2026-12-01\n"},
+		{"expires +30d\nforward me\n", "expires 2026-11-17\nforward me\n"},
+		{"  expires\t+2w  'Gone' # two weeks\n", "  expires\t2026-11-01  'Gone' # two weeks\n"},
+		{"expires +12h", "expires 2026-10-19T08:04:05Z"},
+		{"expires '+30d'", "expires '+30d'"}, // quoted dates are left alone
+		{"# é\r\nexpires +0d\r\n", "# é\nexpires 2026-10-18\n"},
+		{"bounce 'é' # expires +1d\n", "bounce 'é' # expires +1d\n"},
+	}
+
+	for _, test := range tests {
+		got := instruction.ResolveExpiry(test.contents, now)
+		if got != test.want {
+			t.Errorf("%q: %q, want %q", test.contents, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package bearerauth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/wavemechanics/qdeliver/internal/webdavd/handler/rlog"
+)
+
+// Handle passes on requests that have "Authorization: Bearer token".
+//
+func Handle(token string, next http.Handler) http.Handler {
+
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			rlog.Log(req, "no auth")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		} else if subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+			rlog.Log(req, "bad auth")
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		} else {
+			next.ServeHTTP(w, req)
+		}
+	}
+
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,98 @@
+package digestauth
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/wavemechanics/qdeliver/internal/webdavd/handler/rlog"
+)
+
+// Handle passes on requests with HTTP Digest credentials for user and
+// pass, using MD5 and qop=auth. Nonces are kept for the life of the
+// handler, and a nonce count that doesn't increase is refused.
+//
+func Handle(realm, user, pass string, next http.Handler) http.Handler {
+	var mu sync.Mutex
+	nonces := make(map[string]string) // nonce to last nonce count
+
+	challenge := func(w http.ResponseWriter, stale bool) {
+		buf := make([]byte, 16)
+		rand.Read(buf)
+		nonce := hex.EncodeToString(buf)
+
+		mu.Lock()
+		nonces[nonce] = ""
+		mu.Unlock()
+
+		value := fmt.Sprintf(`Digest realm=%q, qop="auth", algorithm=MD5, nonce=%q, opaque="opaque"`, realm, nonce)
+		if stale {
+			value += ", stale=true"
+		}
+		w.Header().Set("WWW-Authenticate", value)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	}
+
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Digest ") {
+			rlog.Log(req, "no auth")
+			challenge(w, false)
+			return
+		}
+		p := params(auth[len("Digest "):])
+
+		mu.Lock()
+		last, known := nonces[p["nonce"]]
+		fresh := known && p["nc"] > last
+		if fresh {
+			nonces[p["nonce"]] = p["nc"]
+		}
+		mu.Unlock()
+
+		if !known || !fresh {
+			rlog.Log(req, "stale nonce")
+			challenge(w, true)
+			return
+		}
+
+		ha1 := sum(user, realm, pass)
+		ha2 := sum(req.Method, p["uri"])
+		want := sum(ha1, p["nonce"], p["nc"], p["cnonce"], "auth", ha2)
+		ok := p["username"] == user && p["uri"] == req.URL.RequestURI() && p["qop"] == "auth" &&
+			subtle.ConstantTimeCompare([]byte(p["response"]), []byte(want)) == 1
+		if !ok {
+			rlog.Log(req, "bad auth")
+			challenge(w, false)
+			return
+		}
+		next.ServeHTTP(w, req)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+func sum(parts ...string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(strings.Join(parts, ":"))))
+}
+
+// params parses the name=value pairs of a Digest Authorization header.
+// It is only good enough for the headers the webdav client sends.
+//
+func params(s string) map[string]string {
+	p := make(map[string]string)
+	for _, field := range strings.Split(s, ",") {
+		eq := strings.IndexByte(field, '=')
+		if eq < 0 {
+			continue
+		}
+		name := strings.TrimSpace(field[:eq])
+		p[name] = strings.Trim(strings.TrimSpace(field[eq+1:]), `"`)
+	}
+	return p
+}
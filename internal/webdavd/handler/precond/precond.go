@@ -0,0 +1,66 @@
+package precond
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/wavemechanics/qdeliver/internal/webdavd/handler/rlog"
+)
+
+// Handle checks the If-Match and If-None-Match headers of PUT and DELETE
+// requests for files in dir before passing them to next, which
+// golang.org/x/net/webdav doesn't do. Writes are serialised, so a check
+// and the write that follows it can't be interleaved with another write.
+//
+// Entity tags are computed the same way as golang.org/x/net/webdav.
+//
+func Handle(dir string, next http.Handler) http.Handler {
+	var mu sync.Mutex
+
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPut && req.Method != http.MethodDelete {
+			next.ServeHTTP(w, req)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+
+		name := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+req.URL.Path)))
+		etag := ""
+		if info, err := os.Stat(name); err == nil {
+			etag = fmt.Sprintf(`"%x%x"`, info.ModTime().UnixNano(), info.Size())
+		}
+
+		if !match(req.Header.Get("If-Match"), etag, true) || !match(req.Header.Get("If-None-Match"), etag, false) {
+			rlog.Log(req, "precondition failed")
+			http.Error(w, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+			return
+		}
+		next.ServeHTTP(w, req)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// match reports whether the precondition in header holds for a file with
+// entity tag etag, which is empty if the file doesn't exist.
+// want is true for If-Match and false for If-None-Match.
+//
+func match(header, etag string, want bool) bool {
+	if header == "" {
+		return true
+	}
+	found := false
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if etag != "" && (tag == "*" || tag == etag) {
+			found = true
+		}
+	}
+	return found == want
+}
@@ -2,13 +2,18 @@ package webdavd
 
 import (
 	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
 	"net/http"
 	"net/http/httptest"
 
 	"golang.org/x/net/webdav"
 
 	"github.com/wavemechanics/qdeliver/internal/webdavd/handler/basicauth"
+	"github.com/wavemechanics/qdeliver/internal/webdavd/handler/bearerauth"
+	"github.com/wavemechanics/qdeliver/internal/webdavd/handler/digestauth"
 	"github.com/wavemechanics/qdeliver/internal/webdavd/handler/id"
+	"github.com/wavemechanics/qdeliver/internal/webdavd/handler/precond"
 	"github.com/wavemechanics/qdeliver/internal/webdavd/handler/rlog"
 )
 
@@ -16,7 +21,21 @@ type Server struct {
 	Dir  string // directory to serve
 	Addr string // port server is listening on
 	User string // login user
-	Pass string // login password
+	Pass string // login password, or bearer token
+
+	// Auth is how clients must authenticate: "basic" (the default),
+	// "bearer", "digest", or "cert" for a TLS client certificate.
+	Auth string
+
+	// TLS makes the server use https. It is implied by Auth "cert".
+	TLS bool
+
+	// For https, Start sets Certificate to the server's certificate, and
+	// RootCAs to a pool that trusts it. When Auth is "cert", it also sets
+	// ClientCert to a certificate the server accepts.
+	Certificate *x509.Certificate
+	RootCAs     *x509.CertPool
+	ClientCert  tls.Certificate
 }
 
 func (s *Server) Start() func() {
@@ -39,10 +58,41 @@ func (s *Server) Start() func() {
 		return uok && pok
 	}
 
+	var auth http.Handler
+	switch s.Auth {
+	case "", "basic":
+		auth = basicauth.Handle("", checkpw, precond.Handle(s.Dir, srv))
+	case "bearer":
+		auth = bearerauth.Handle(s.Pass, precond.Handle(s.Dir, srv))
+	case "digest":
+		auth = digestauth.Handle("webdavd", s.User, s.Pass, precond.Handle(s.Dir, srv))
+	case "cert":
+		auth = precond.Handle(s.Dir, srv)
+	default:
+		panic("webdavd: unknown auth " + s.Auth)
+	}
+
 	mux := http.NewServeMux()
-	mux.Handle("/", id.Handle(id.Generate, rlog.Handle(basicauth.Handle("", checkpw, srv))))
+	mux.Handle("/", id.Handle(id.Generate, rlog.Handle(auth)))
 
-	server := httptest.NewServer(mux)
+	var server *httptest.Server
+	if s.TLS || s.Auth == "cert" {
+		server = httptest.NewUnstartedServer(mux)
+		if s.Auth == "cert" {
+			ca, cert := clientCert()
+			s.ClientCert = cert
+			server.TLS = &tls.Config{
+				ClientAuth: tls.RequireAndVerifyClientCert,
+				ClientCAs:  ca,
+			}
+		}
+		server.StartTLS()
+		s.Certificate = server.Certificate()
+		s.RootCAs = x509.NewCertPool()
+		s.RootCAs.AddCert(s.Certificate)
+	} else {
+		server = httptest.NewServer(mux)
+	}
 	s.Addr = server.URL
 
 	return func() {
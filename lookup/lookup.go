@@ -5,38 +5,107 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/wavemechanics/qdeliver/instruction"
 	"github.com/wavemechanics/qdeliver/store"
+	"github.com/wavemechanics/qdeliver/store/signed"
 )
 
+// Default is the key holding instructions for new addresses.
+//
+const Default = "default"
+
+// CounterSuffix ends the keys under which limit instructions keep their
+// counters, next to the address files. Lookup and Resolve treat a localpart
+// ending in it as not existing, so mail can't read, create or replace a
+// counter.
+//
+const CounterSuffix = ".limit"
+
+// reserved lists the suffixes of keys that aren't address files: counters,
+// and the sidecar signatures of signed storage. A localpart ending in one
+// of them is treated as not existing.
+//
+var reserved = []string{CounterSuffix, signed.SigSuffix}
+
 // Lookup returns the delivery instructions for localpart in storage s.
 // If localpart doesn't exist, it will be created if default instructions exist.
-// created will be true if a new key for localpart was created.
+// Relative dates in expires instructions are made absolute in the copy,
+// unless s is Verbatim. created will be true if a new key for localpart was created.
 //
-func Lookup(ctx context.Context, s store.Storage, localpart string) (instruction string, created bool, err error) {
-	contents, err := s.Get(ctx, localpart)
-	if err == nil {
-		return contents, false, nil
-	}
-
-	if !errors.Is(err, os.ErrNotExist) {
+// The copy is only made if localpart still doesn't exist, so if two
+// deliveries race to create it, only one reports created, and the other
+// returns the winner's instructions.
+//
+func Lookup(ctx context.Context, s store.Storage, localpart string) (instructions string, created bool, err error) {
+	key, contents, err := Resolve(ctx, s, localpart)
+	if err != nil {
 		return "", false, err
 	}
+	if key == localpart {
+		return contents, false, nil
+	}
 
-	contents, err = s.Get(ctx, "default")
-	if err != nil {
-		return "", false, err
+	now := time.Now()
+	if _, ok := s.(Verbatim); !ok {
+		contents = instruction.ResolveExpiry(contents, now)
 	}
 
 	sender := os.Getenv("SENDER")
-	timestamp := time.Now().UTC().Format(time.RFC3339Nano)
+	timestamp := now.UTC().Format(time.RFC3339Nano)
 	contents += fmt.Sprintf("\n# Sender: %s\n# Timestamp: %s\n", sender, timestamp)
 
-	err = s.Set(ctx, localpart, contents)
+	err = store.Create(ctx, s, localpart, contents)
+	if errors.Is(err, os.ErrExist) {
+		contents, err = s.Get(ctx, localpart)
+		if err != nil {
+			return "", false, err
+		}
+		return contents, false, nil
+	}
 	if err != nil {
 		return "", false, err
 	}
 
 	return contents, true, nil
 }
+
+// A Verbatim storage only accepts exact copies of the default
+// instructions, such as storage that requires them to be signed.
+// Comments may still be added at the end.
+//
+type Verbatim interface {
+	store.Storage
+	Verbatim()
+}
+
+// Resolve finds the delivery instructions for localpart in storage s the
+// same way Lookup does, but never writes to s.
+// key is localpart if it exists, otherwise it is Default, which Lookup
+// would copy to localpart. A localpart ending in CounterSuffix or
+// signed.SigSuffix never exists.
+//
+func Resolve(ctx context.Context, s store.Storage, localpart string) (key, contents string, err error) {
+	for _, suffix := range reserved {
+		if strings.HasSuffix(localpart, suffix) {
+			return "", "", fmt.Errorf("%s: %w", localpart, os.ErrNotExist)
+		}
+	}
+
+	contents, err = s.Get(ctx, localpart)
+	if err == nil {
+		return localpart, contents, nil
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", "", err
+	}
+
+	contents, err = s.Get(ctx, Default)
+	if err != nil {
+		return "", "", err
+	}
+	return Default, contents, nil
+}
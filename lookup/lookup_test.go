@@ -6,6 +6,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/wavemechanics/qdeliver/lookup"
 	"github.com/wavemechanics/qdeliver/store/mem"
@@ -58,3 +59,138 @@ func TestFound(t *testing.T) {
 		t.Fatalf("Lookup contents: %q, want %q", contents, "some value")
 	}
 }
+
+func TestResolve(t *testing.T) {
+	var s mem.Storage
+
+	ctx := context.TODO()
+
+	_, _, err := lookup.Resolve(ctx, &s, "missing")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Resolve: %v, want Not Found", err)
+	}
+
+	s.Set(ctx, "default", "default value")
+	s.Set(ctx, "localpart", "some value")
+
+	var tests = []struct {
+		localpart string
+		key       string
+		contents  string
+	}{
+		{"localpart", "localpart", "some value"},
+		{"missing", "default", "default value"},
+	}
+
+	for _, test := range tests {
+		key, contents, err := lookup.Resolve(ctx, &s, test.localpart)
+		if err != nil {
+			t.Errorf("Resolve %q: %v", test.localpart, err)
+			continue
+		}
+		if key != test.key || contents != test.contents {
+			t.Errorf("Resolve %q: %q, %q, want %q, %q", test.localpart, key, contents, test.key, test.contents)
+		}
+	}
+
+	// Resolve must not create anything
+	if _, err = s.Get(ctx, "missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf(`Resolve created "missing": %v`, err)
+	}
+}
+
+func TestExpiryResolved(t *testing.T) {
+	var s mem.Storage
+
+	ctx := context.TODO()
+	s.Set(ctx, "default", "expires +1d\nforward me@example.com\n")
+
+	contents, created, err := lookup.Lookup(ctx, &s, "temporary")
+	if err != nil || !created {
+		t.Fatalf("Lookup: %v, %v, want created", created, err)
+	}
+	want := "expires " + time.Now().UTC().AddDate(0, 0, 1).Format("2006-01-02") + "\n"
+	if !strings.HasPrefix(contents, want) {
+		t.Fatalf("Lookup contents: %q, want prefix %q", contents, want)
+	}
+	if stored, _ := s.Get(ctx, "temporary"); stored != contents {
+		t.Fatalf("stored contents: %q, want %q", stored, contents)
+	}
+}
+
+// racer is a Storage in which another delivery creates key just after it
+// is first found to be missing.
+type racer struct {
+	*mem.Storage
+	key    string
+	winner string
+}
+
+func (r *racer) Get(ctx context.Context, key string) (string, error) {
+	value, err := r.Storage.Get(ctx, key)
+	if key == r.key && r.winner != "" {
+		r.Storage.Set(ctx, key, r.winner)
+		r.winner = ""
+	}
+	return value, err
+}
+
+func TestLostRace(t *testing.T) {
+	ctx := context.TODO()
+	s := &racer{Storage: &mem.Storage{}, key: "new", winner: "winner's copy"}
+	s.Set(ctx, "default", "default value")
+
+	contents, created, err := lookup.Lookup(ctx, s, "new")
+	if err != nil {
+		t.Fatalf("Lookup: %v, want nil", err)
+	}
+	if created {
+		t.Fatal("Lookup: created true after losing the race")
+	}
+	if contents != "winner's copy" {
+		t.Fatalf("Lookup contents: %q, want %q", contents, "winner's copy")
+	}
+}
+
+// TestCounter tests that mail can't reach or create the counter of a limit
+// instruction
+func TestCounter(t *testing.T) {
+	var s mem.Storage
+
+	ctx := context.TODO()
+	s.Set(ctx, "default", "limit 1/day bounce")
+	s.Set(ctx, "joe-x.limit", `{"start":"2026-10-18T00:00:00Z","count":1}`)
+
+	for _, localpart := range []string{"joe-x.limit", "joe-y.limit"} {
+		if _, created, err := lookup.Lookup(ctx, &s, localpart); !errors.Is(err, os.ErrNotExist) || created {
+			t.Errorf("Lookup %q: %v, created %v, want %v", localpart, err, created, os.ErrNotExist)
+		}
+		if _, _, err := lookup.Resolve(ctx, &s, localpart); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Resolve %q: %v, want %v", localpart, err, os.ErrNotExist)
+		}
+	}
+	if _, err := s.Get(ctx, "joe-y.limit"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("joe-y.limit was created from the default: %v", err)
+	}
+	if value, _ := s.Get(ctx, "joe-x.limit"); value != `{"start":"2026-10-18T00:00:00Z","count":1}` {
+		t.Errorf("joe-x.limit was changed to %q", value)
+	}
+}
+
+// TestSidecar tests that mail can't reach or create a sidecar signature
+func TestSidecar(t *testing.T) {
+	var s mem.Storage
+
+	ctx := context.TODO()
+	s.Set(ctx, "default", "drop")
+	s.Set(ctx, "joe.sig", "signature")
+
+	for _, localpart := range []string{"joe.sig", "fred.sig"} {
+		if _, created, err := lookup.Lookup(ctx, &s, localpart); !errors.Is(err, os.ErrNotExist) || created {
+			t.Errorf("Lookup %q: %v, created %v, want %v", localpart, err, created, os.ErrNotExist)
+		}
+	}
+	if _, err := s.Get(ctx, "fred.sig"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("fred.sig was created from the default: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package sign
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/wavemechanics/etype"
+	"github.com/wavemechanics/qdeliver/token"
+)
+
+const (
+	ErrUnsigned     = etype.Sentinel("not signed, and the account requires signed instruction files")
+	ErrBadSignature = etype.Sentinel("signature does not match; file changed since it was signed")
+	ErrBadKey       = etype.Sentinel("not a base64 ed25519 key")
+)
+
+// TrailerPrefix starts the comment line that holds an embedded signature.
+//
+const TrailerPrefix = "# qdeliver-signature: "
+
+// Body returns the part of an address file that a signature covers: every
+// line up to the last one with an instruction on it, joined with "\n".
+// Comments and blank lines at the end, which include the trailer and the
+// comments qdeliver adds when it copies the default file, can change
+// without breaking the signature, and so can line endings.
+//
+func Body(contents string) string {
+	body, _ := split(contents)
+	return strings.Join(body, "\n")
+}
+
+// split splits contents into the lines of its body, and the comments and
+// blank lines that follow.
+//
+func split(contents string) (body, tail []string) {
+	lines := token.SplitFile(contents)
+	end := len(lines)
+	for end > 0 {
+		tokens, _, err := token.Scan(lines[end-1])
+		if err != nil || len(tokens) != 0 {
+			break
+		}
+		end--
+	}
+	return lines[:end], lines[end:]
+}
+
+// Trailer returns the base64 signature embedded in contents, if any.
+// Only the comments and blank lines at the end are searched, and if
+// there is more than one trailer, the last is used.
+//
+func Trailer(contents string) (sig string, ok bool) {
+	_, tail := split(contents)
+	for _, line := range tail {
+		if strings.HasPrefix(line, TrailerPrefix) {
+			sig, ok = strings.TrimSpace(line[len(TrailerPrefix):]), true
+		}
+	}
+	return sig, ok
+}
+
+// Sign returns the base64 signature of contents.
+//
+func Sign(contents string, key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(Body(contents))))
+}
+
+// Embed returns contents signed with key, with the signature in a trailer
+// line at the end. Any trailer already in contents is replaced.
+//
+func Embed(contents string, key ed25519.PrivateKey) string {
+	lines, tail := split(contents)
+	for _, line := range tail {
+		if !strings.HasPrefix(line, TrailerPrefix) {
+			lines = append(lines, line)
+		}
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	lines = append(lines, TrailerPrefix+Sign(contents, key))
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Verify checks that sig, a base64 signature, was made by key for contents.
+// An empty sig means there was no signature.
+//
+func Verify(contents, sig string, key ed25519.PublicKey) error {
+	if sig == "" {
+		return ErrUnsigned
+	}
+	buf, err := base64.StdEncoding.DecodeString(strings.TrimSpace(sig))
+	if err != nil || len(buf) != ed25519.SignatureSize {
+		return fmt.Errorf("%w: signature is not base64 ed25519", ErrBadSignature)
+	}
+	if !ed25519.Verify(key, []byte(Body(contents)), buf) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// ParsePublicKey decodes a base64 ed25519 public key.
+//
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	buf, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(buf) != ed25519.PublicKeySize {
+		return nil, ErrBadKey
+	}
+	return ed25519.PublicKey(buf), nil
+}
+
+// ParsePrivateKey decodes a base64 ed25519 private key seed, as written by
+// "qdeliver --admin sign --generate".
+//
+func ParsePrivateKey(s string) (ed25519.PrivateKey, error) {
+	buf, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(buf) != ed25519.SeedSize {
+		return nil, ErrBadKey
+	}
+	return ed25519.NewKeyFromSeed(buf), nil
+}
@@ -0,0 +1,110 @@
+package sign_test
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/wavemechanics/qdeliver/sign"
+)
+
+func keys() (ed25519.PublicKey, ed25519.PrivateKey) {
+	seed := make([]byte, ed25519.SeedSize)
+	priv := ed25519.NewKeyFromSeed(seed)
+	return priv.Public().(ed25519.PublicKey), priv
+}
+
+func TestBody(t *testing.T) {
+	var tests = []struct {
+		contents string
+		body     string
+	}{
+		{"", ""},
+		{"# just a comment\n", ""},
+		{"forward a@example.com\n", "forward a@example.com"},
+		{"forward a@example.com\r\n\n# Sender: x\n", "forward a@example.com"},
+		{"# about\nmatch-subject x\n# middle\ndrop\n\n", "# about\nmatch-subject x\n# middle\ndrop"},
+	}
+	for _, test := range tests {
+		if body := sign.Body(test.contents); body != test.body {
+			t.Errorf("Body(%q): %q, want %q", test.contents, body, test.body)
+		}
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	pub, priv := keys()
+	contents := "forward me@example.com\n"
+	sig := sign.Sign(contents, priv)
+
+	var tests = []struct {
+		name     string
+		contents string
+		sig      string
+		err      error
+	}{
+		{"signed", contents, sig, nil},
+		{"comment added", contents + "# Sender: someone\n", sig, nil},
+		{"crlf", "forward me@example.com\r\n", sig, nil},
+		{"unsigned", contents, "", sign.ErrUnsigned},
+		{"tampered", "forward thief@example.com\n", sig, sign.ErrBadSignature},
+		{"instruction added", contents + "drop\n", sig, sign.ErrBadSignature},
+		{"garbage", contents, "not base64!", sign.ErrBadSignature},
+	}
+	for _, test := range tests {
+		err := sign.Verify(test.contents, test.sig, pub)
+		if !errors.Is(err, test.err) || (err == nil) != (test.err == nil) {
+			t.Errorf("%s: %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestEmbed(t *testing.T) {
+	pub, priv := keys()
+	contents := "forward me@example.com\n# note\n\n"
+
+	signed := sign.Embed(contents, priv)
+	if !strings.HasPrefix(signed, "forward me@example.com\n# note\n"+sign.TrailerPrefix) {
+		t.Fatalf("Embed: %q", signed)
+	}
+	sig, ok := sign.Trailer(signed)
+	if !ok {
+		t.Fatalf("Trailer(%q): not found", signed)
+	}
+	if err := sign.Verify(signed, sig, pub); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	again := sign.Embed(signed+"# Sender: someone\n", priv)
+	if n := strings.Count(again, sign.TrailerPrefix); n != 1 {
+		t.Fatalf("Embed of signed contents: %d trailers in %q, want 1", n, again)
+	}
+
+	if _, ok := sign.Trailer("# " + sign.TrailerPrefix[2:] + sig + "\nforward me@example.com\n"); ok {
+		t.Fatal("Trailer: found a trailer before the instructions")
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	pub, priv := keys()
+
+	got, err := sign.ParsePublicKey(base64.StdEncoding.EncodeToString(pub) + "\n")
+	if err != nil || !got.Equal(pub) {
+		t.Fatalf("ParsePublicKey: %v", err)
+	}
+	gotPriv, err := sign.ParsePrivateKey(base64.StdEncoding.EncodeToString(priv.Seed()))
+	if err != nil || !gotPriv.Equal(priv) {
+		t.Fatalf("ParsePrivateKey: %v", err)
+	}
+
+	for _, s := range []string{"", "short", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := sign.ParsePublicKey(s); !errors.Is(err, sign.ErrBadKey) {
+			t.Errorf("ParsePublicKey(%q): %v, want %v", s, err, sign.ErrBadKey)
+		}
+		if _, err := sign.ParsePrivateKey(s); !errors.Is(err, sign.ErrBadKey) {
+			t.Errorf("ParsePrivateKey(%q): %v, want %v", s, err, sign.ErrBadKey)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/wavemechanics/qdeliver/store"
+)
+
+// Storage wraps another Storage, keeping the last value read for each key
+// in a local directory. If the backend is a store.Revalidator, cached values
+// are revalidated with conditional requests instead of being fetched again.
+// If the backend can't be reached, which it shows by returning an error
+// wrapping store.ErrUnavailable, the cached value is returned instead.
+// Other errors, such as a refused login, are returned as they are.
+//
+type Storage struct {
+	backend store.Storage
+	dir     string
+}
+
+// entry is what is kept in a cache file.
+//
+type entry struct {
+	Revision store.Revision `json:"revision"`
+	Value    string         `json:"value"`
+}
+
+// New returns a Storage caching values from backend in dir.
+// dir is created if it doesn't exist. If backend is a store.Versioner, so
+// is the Storage returned.
+//
+func New(dir string, backend store.Storage) (store.Storage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &Storage{
+		backend: backend,
+		dir:     dir,
+	}
+	if v, ok := backend.(store.Versioner); ok {
+		return &versioned{Storage: s, backend: v}, nil
+	}
+	return s, nil
+}
+
+// versioned is a Storage whose backend is a store.Versioner. Values read
+// to be changed with SetIf go straight to the backend; a cached copy is of
+// no use to them, and is dropped so it can't be served once it is stale.
+//
+type versioned struct {
+	*Storage
+	backend store.Versioner
+}
+
+func (v *versioned) GetVersion(ctx context.Context, key string) (string, store.Revision, error) {
+	v.remove(key)
+	return v.backend.GetVersion(ctx, key)
+}
+
+func (v *versioned) SetIf(ctx context.Context, key, value string, rev store.Revision) error {
+	v.remove(key)
+	return v.backend.SetIf(ctx, key, value, rev)
+}
+
+func (s *Storage) Get(ctx context.Context, key string) (string, error) {
+	if key == "" {
+		return "", store.ErrEmptyKey
+	}
+
+	cached, err := s.load(key)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("cache: %s: %v", key, err)
+	}
+	found := err == nil
+
+	var value string
+	var rev store.Revision
+	if r, ok := s.backend.(store.Revalidator); ok {
+		value, rev, err = r.GetIfChanged(ctx, key, cached.Revision)
+	} else {
+		value, err = s.backend.Get(ctx, key)
+	}
+
+	switch {
+	case err == nil:
+		s.save(key, entry{Revision: rev, Value: value})
+		return value, nil
+	case errors.Is(err, store.ErrNotModified) && found:
+		return cached.Value, nil
+	case errors.Is(err, os.ErrNotExist):
+		s.remove(key)
+		return "", err
+	case found && errors.Is(err, store.ErrUnavailable):
+		log.Printf("cache: %s: %v; using cached copy", key, err)
+		return cached.Value, nil
+	}
+	return "", err
+}
+
+// Set writes value to the backend, then to the cache.
+// The cached copy has no revision, so the next Get fetches it again.
+//
+func (s *Storage) Set(ctx context.Context, key, value string) error {
+	if err := s.backend.Set(ctx, key, value); err != nil {
+		return err
+	}
+	s.save(key, entry{Value: value})
+	return nil
+}
+
+// Create creates key in the backend, then caches it. It is only atomic if
+// the backend is a store.Creator.
+//
+func (s *Storage) Create(ctx context.Context, key, value string) error {
+	if err := store.Create(ctx, s.backend, key, value); err != nil {
+		return err
+	}
+	s.save(key, entry{Value: value})
+	return nil
+}
+
+// path returns the name of the cache file for key.
+//
+func (s *Storage) path(key string) string {
+	return filepath.Join(s.dir, url.PathEscape(key)+".json")
+}
+
+func (s *Storage) load(key string) (entry, error) {
+	var e entry
+	buf, err := ioutil.ReadFile(s.path(key))
+	if err != nil {
+		return e, err
+	}
+	err = json.Unmarshal(buf, &e)
+	return e, err
+}
+
+// save writes a cache file atomically. The cache is only an optimisation,
+// so failures are logged rather than returned.
+//
+func (s *Storage) save(key string, e entry) {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("cache: %s: %v", key, err)
+		return
+	}
+	tmp, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		log.Printf("cache: %s: %v", key, err)
+		return
+	}
+	_, err = tmp.Write(buf)
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("cache: %s: %v", key, err)
+	}
+}
+
+func (s *Storage) remove(key string) {
+	err := os.Remove(s.path(key))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("cache: %s: %v", key, err)
+	}
+}
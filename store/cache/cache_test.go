@@ -0,0 +1,193 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/wavemechanics/qdeliver/store"
+	"github.com/wavemechanics/qdeliver/store/cache"
+	"github.com/wavemechanics/qdeliver/store/mem"
+)
+
+// backend is a revalidating store that can be taken down.
+type backend struct {
+	mem.Storage
+	down    bool
+	refuse  error // returned instead of the value, if set
+	fetches int   // number of full values returned
+}
+
+func (b *backend) GetIfChanged(ctx context.Context, key string, rev store.Revision) (string, store.Revision, error) {
+	if b.down {
+		return "", store.Revision{}, store.Unavailable(errors.New("connection refused"))
+	}
+	if b.refuse != nil {
+		return "", store.Revision{}, b.refuse
+	}
+	value, err := b.Get(ctx, key)
+	if err != nil {
+		return "", store.Revision{}, err
+	}
+	current := store.Revision{ETag: strconv.Quote(value)}
+	if rev == current {
+		return "", rev, store.ErrNotModified
+	}
+	b.fetches++
+	return value, current, nil
+}
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestCache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.TODO()
+	b := &backend{}
+	s, err := cache.New(dir, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.Get(ctx, ""); err != store.ErrEmptyKey {
+		t.Fatalf("Get empty key: %v, want %v", err, store.ErrEmptyKey)
+	}
+
+	// nothing cached, backend down
+	b.down = true
+	if _, err = s.Get(ctx, "key"); err == nil {
+		t.Fatal("Get with nothing cached and backend down: expected error")
+	}
+	b.down = false
+
+	if err = s.Set(ctx, "key", "one"); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		down    bool
+		value   string
+		fetches int
+	}{
+		{false, "one", 1}, // Set doesn't record a revision, so fetch
+		{false, "one", 1}, // revalidated, not fetched
+		{true, "one", 1},  // served from cache
+	}
+
+	for i, test := range tests {
+		b.down = test.down
+		value, err := s.Get(ctx, "key")
+		if err != nil {
+			t.Fatalf("%d: Get: %v", i, err)
+		}
+		if value != test.value || b.fetches != test.fetches {
+			t.Fatalf("%d: Get: %q after %d fetches, want %q after %d", i, value, b.fetches, test.value, test.fetches)
+		}
+	}
+
+	// changed behind the cache's back
+	b.down = false
+	b.Storage.Set(ctx, "key", "two")
+	if value, _ := s.Get(ctx, "key"); value != "two" {
+		t.Fatalf("Get after change: %q, want %q", value, "two")
+	}
+
+	// a server that answers with a refusal isn't down
+	refused := errors.New("403 Forbidden")
+	b.refuse = refused
+	if value, err := s.Get(ctx, "key"); !errors.Is(err, refused) {
+		t.Fatalf("Get refused: %q, %v, want %v", value, err, refused)
+	}
+	b.refuse = nil
+
+	// a new Storage on the same directory sees the cached copy
+	b.down = true
+	s, err = cache.New(dir, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := s.Get(ctx, "key"); value != "two" || err != nil {
+		t.Fatalf("Get from new cache: %q, %v, want %q", value, err, "two")
+	}
+}
+
+func TestCacheNotExist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestCacheNotExist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.TODO()
+	var b mem.Storage // not a Revalidator
+	s, err := cache.New(dir, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.Set(ctx, "key", "value")
+	if value, err := s.Get(ctx, "key"); value != "value" || err != nil {
+		t.Fatalf("Get: %q, %v, want %q", value, err, "value")
+	}
+
+	// a deleted key is not served from the cache
+	b = mem.Storage{}
+	if _, err = s.Get(ctx, "key"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Get deleted key: %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestCacheVersioner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestCacheVersioner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.TODO()
+	b := &backend{}
+	s, err := cache.New(dir, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, ok := s.(store.Versioner)
+	if !ok {
+		t.Fatal("not a Versioner with a versioned backend")
+	}
+
+	if err = s.Set(ctx, "key", "one"); err != nil {
+		t.Fatal(err)
+	}
+	value, rev, err := v.GetVersion(ctx, "key")
+	if value != "one" || err != nil {
+		t.Fatalf("GetVersion: %q, %v, want %q", value, err, "one")
+	}
+	if err = v.SetIf(ctx, "key", "two", rev); err != nil {
+		t.Fatal(err)
+	}
+	if err = v.SetIf(ctx, "key", "three", rev); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("SetIf with old revision: %v, want %v", err, store.ErrConflict)
+	}
+	if value, _ := b.Storage.Get(ctx, "key"); value != "two" {
+		t.Fatalf("backend: %q, want %q", value, "two")
+	}
+
+	// the cached copy was dropped rather than left stale
+	b.down = true
+	if value, err := s.Get(ctx, "key"); err == nil {
+		t.Fatalf("Get with backend down: %q, want error", value)
+	}
+
+	plain, err := cache.New(dir, struct{ store.Storage }{b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := plain.(store.Versioner); ok {
+		t.Fatal("Versioner without a versioned backend")
+	}
+}
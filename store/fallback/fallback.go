@@ -0,0 +1,140 @@
+package fallback
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+
+	"github.com/wavemechanics/qdeliver/store"
+)
+
+// Storage reads from the first of several backends that answers, so that
+// address files can still be found when the primary backend is down.
+// Writes go to the primary backend, which is the first one, and are copied
+// to the others if replicate is set.
+//
+// A backend that answers that a key doesn't exist is believed; only other
+// errors make Storage try the next backend, so a stale copy can't bring
+// back a file deleted from the primary.
+//
+type Storage struct {
+	backends  []store.Storage
+	replicate bool
+}
+
+// New returns a Storage using backends in order. backends must not be empty.
+// If the primary backend is a store.Versioner, so is the Storage returned.
+//
+func New(backends []store.Storage, replicate bool) store.Storage {
+	s := &Storage{
+		backends:  backends,
+		replicate: replicate,
+	}
+	if v, ok := backends[0].(store.Versioner); ok {
+		return &versioned{Storage: s, primary: v}
+	}
+	return s
+}
+
+// versioned is a Storage whose primary backend is a store.Versioner.
+// Conditional reads and writes only use the primary: a revision from one
+// backend means nothing to another, and a value read from a stale copy
+// must not be written back over a newer one.
+//
+type versioned struct {
+	*Storage
+	primary store.Versioner
+}
+
+func (v *versioned) GetVersion(ctx context.Context, key string) (string, store.Revision, error) {
+	return v.primary.GetVersion(ctx, key)
+}
+
+func (v *versioned) SetIf(ctx context.Context, key, value string, rev store.Revision) error {
+	return v.primary.SetIf(ctx, key, value, rev)
+}
+
+func (s *Storage) Get(ctx context.Context, key string) (string, error) {
+	var value string
+	err := s.each(ctx, func(b store.Storage) error {
+		var err error
+		value, err = b.Get(ctx, key)
+		return err
+	})
+	return value, err
+}
+
+// List lists the keys in the first backend that answers and can list them.
+//
+func (s *Storage) List(ctx context.Context) ([]string, error) {
+	var keys []string
+	err := s.each(ctx, func(b store.Storage) error {
+		lister, ok := b.(store.Lister)
+		if !ok {
+			return errors.New("storage cannot list address files")
+		}
+		var err error
+		keys, err = lister.List(ctx)
+		return err
+	})
+	return keys, err
+}
+
+func (s *Storage) Set(ctx context.Context, key, value string) error {
+	if err := s.backends[0].Set(ctx, key, value); err != nil {
+		return err
+	}
+	s.copy(ctx, key, value)
+	return nil
+}
+
+// Create creates key in the primary backend. It is atomic only if the
+// primary is a store.Creator.
+//
+func (s *Storage) Create(ctx context.Context, key, value string) error {
+	if err := store.Create(ctx, s.backends[0], key, value); err != nil {
+		return err
+	}
+	s.copy(ctx, key, value)
+	return nil
+}
+
+// each calls f for each backend in turn until one succeeds or answers
+// that the key doesn't exist, and returns that result. If every backend
+// fails, it returns the primary's error.
+//
+func (s *Storage) each(ctx context.Context, f func(b store.Storage) error) error {
+	var first error
+	for i, b := range s.backends {
+		err := f(b)
+		if err == nil || errors.Is(err, os.ErrNotExist) || errors.Is(err, store.ErrEmptyKey) {
+			return err
+		}
+		if i+1 < len(s.backends) {
+			log.Printf("fallback: backend %d: %v; trying the next", i+1, err)
+		}
+		if first == nil {
+			first = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return first
+}
+
+// copy writes value to the backends after the primary, if replicate is set.
+// A secondary that can't be written to only makes it stale, so errors are
+// logged rather than returned.
+//
+func (s *Storage) copy(ctx context.Context, key, value string) {
+	if !s.replicate {
+		return
+	}
+	for i, b := range s.backends[1:] {
+		if err := b.Set(ctx, key, value); err != nil {
+			log.Printf("fallback: backend %d: %s: %v", i+2, key, err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package fallback_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/wavemechanics/qdeliver/store"
+	"github.com/wavemechanics/qdeliver/store/fallback"
+	"github.com/wavemechanics/qdeliver/store/mem"
+)
+
+var errDown = errors.New("server down")
+
+// down is a Storage that can't be reached.
+type down struct{}
+
+func (down) Get(ctx context.Context, key string) (string, error) { return "", errDown }
+func (down) Set(ctx context.Context, key, value string) error    { return errDown }
+
+func TestGet(t *testing.T) {
+	ctx := context.TODO()
+	primary, secondary := &mem.Storage{}, &mem.Storage{}
+	primary.Set(ctx, "a", "primary a")
+	secondary.Set(ctx, "a", "secondary a")
+	secondary.Set(ctx, "b", "secondary b")
+
+	var tests = []struct {
+		name     string
+		backends []store.Storage
+		key      string
+		value    string
+		err      error
+	}{
+		{"primary", []store.Storage{primary, secondary}, "a", "primary a", nil},
+		{"primary says missing", []store.Storage{primary, secondary}, "b", "", os.ErrNotExist},
+		{"primary down", []store.Storage{down{}, secondary}, "a", "secondary a", nil},
+		{"primary down, missing", []store.Storage{down{}, secondary}, "c", "", os.ErrNotExist},
+		{"all down", []store.Storage{down{}, down{}}, "a", "", errDown},
+	}
+
+	for _, test := range tests {
+		s := fallback.New(test.backends, false)
+		value, err := s.Get(ctx, test.key)
+		if value != test.value || !errors.Is(err, test.err) || (err == nil) != (test.err == nil) {
+			t.Errorf("%s: %q, %v, want %q, %v", test.name, value, err, test.value, test.err)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	ctx := context.TODO()
+	secondary := &mem.Storage{}
+	secondary.Set(ctx, "a", "")
+
+	s := fallback.New([]store.Storage{down{}, secondary}, false)
+	keys, err := s.(store.Lister).List(ctx)
+	if err != nil || !reflect.DeepEqual(keys, []string{"a"}) {
+		t.Fatalf("List: %q, %v", keys, err)
+	}
+}
+
+func TestSet(t *testing.T) {
+	ctx := context.TODO()
+
+	for _, replicate := range []bool{false, true} {
+		primary, secondary := &mem.Storage{}, &mem.Storage{}
+		s := fallback.New([]store.Storage{primary, secondary, down{}}, replicate)
+
+		if err := s.Set(ctx, "a", "value"); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		if err := store.Create(ctx, s, "b", "value"); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if err := store.Create(ctx, s, "b", "again"); !errors.Is(err, os.ErrExist) {
+			t.Fatalf("Create again: %v, want %v", err, os.ErrExist)
+		}
+
+		for _, key := range []string{"a", "b"} {
+			if value, _ := primary.Get(ctx, key); value != "value" {
+				t.Errorf("replicate %v: primary %s: %q, want %q", replicate, key, value, "value")
+			}
+			_, err := secondary.Get(ctx, key)
+			if replicate != (err == nil) {
+				t.Errorf("replicate %v: secondary %s: %v", replicate, key, err)
+			}
+		}
+	}
+
+	s := fallback.New([]store.Storage{down{}, &mem.Storage{}}, true)
+	if err := s.Set(ctx, "a", "value"); err != errDown {
+		t.Fatalf("Set with primary down: %v, want %v", err, errDown)
+	}
+}
+
+func TestVersioner(t *testing.T) {
+	ctx := context.TODO()
+	primary, secondary := &mem.Storage{}, &mem.Storage{}
+
+	if _, ok := fallback.New([]store.Storage{down{}, primary}, false).(store.Versioner); ok {
+		t.Fatal("Versioner without a versioned primary")
+	}
+	s, ok := fallback.New([]store.Storage{primary, secondary}, true).(store.Versioner)
+	if !ok {
+		t.Fatal("not a Versioner with a versioned primary")
+	}
+
+	_, rev, err := s.GetVersion(ctx, "a")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("GetVersion: %v, want %v", err, os.ErrNotExist)
+	}
+	primary.Set(ctx, "a", "one")
+	if _, rev, err = s.GetVersion(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetIf(ctx, "a", "two", rev); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetIf(ctx, "a", "three", rev); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("SetIf with old revision: %v, want %v", err, store.ErrConflict)
+	}
+	if value, _ := primary.Get(ctx, "a"); value != "two" {
+		t.Fatalf("primary: %q, want %q", value, "two")
+	}
+}
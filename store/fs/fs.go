@@ -0,0 +1,233 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/wavemechanics/qdeliver/store"
+	"github.com/wavemechanics/qdeliver/store/layout"
+)
+
+// Storage keeps each key in a file in a local directory, which may be a
+// network mount. By default the file is named <key>.txt; see WithLayout.
+//
+type Storage struct {
+	dir    string
+	layout layout.Layout
+}
+
+// An Option changes the way a Storage works.
+//
+type Option func(*Storage)
+
+// WithLayout sets how keys are mapped to file names. By default they are
+// layout.Default.
+//
+func WithLayout(l layout.Layout) Option {
+	return func(s *Storage) {
+		s.layout = l
+	}
+}
+
+// New returns a Storage for the existing directory dir.
+//
+func New(dir string, options ...Option) (*Storage, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: errors.New("not a directory")}
+	}
+	s := &Storage{
+		dir:    dir,
+		layout: layout.Default,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s, nil
+}
+
+// path returns the file name for key. Keys that could name a file outside
+// the directory are rejected.
+//
+func (s *Storage) path(key string) (string, error) {
+	if key == "" {
+		return "", store.ErrEmptyKey
+	}
+	if strings.ContainsAny(key, "/\\\x00") || key == "." || key == ".." || !s.layout.Valid(key) {
+		return "", store.ErrBadKey
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(s.layout.Name(key))), nil
+}
+
+func (s *Storage) Get(ctx context.Context, key string) (string, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return "", err
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// Set writes value to a temporary file and renames it into place, so
+// readers never see a partly written file.
+//
+func (s *Storage) Set(ctx context.Context, key, value string) error {
+	path, tmp, err := s.write(key, value)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // fails harmlessly once renamed
+	return os.Rename(tmp, path)
+}
+
+// Create writes value to a temporary file and links it into place, which
+// fails if key already exists. If the filesystem doesn't support hard
+// links, the file is created with O_EXCL and written in place instead.
+//
+func (s *Storage) Create(ctx context.Context, key, value string) error {
+	path, tmp, err := s.write(key, value)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	err = os.Link(tmp, path)
+	if err == nil || os.IsExist(err) {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(value); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// write writes value to a new temporary file in the directory that is to
+// hold key, creating the directory if the layout needs it. It returns the
+// file name for key, and the name of the temporary file.
+//
+func (s *Storage) write(key, value string) (path, tmpname string, err error) {
+	path, err = s.path(key)
+	if err != nil {
+		return "", "", err
+	}
+	dir := filepath.Dir(path)
+	if s.layout.Depth() > 0 {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return "", "", err
+		}
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return "", "", err
+	}
+
+	if _, err = tmp.WriteString(value); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", "", err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", "", err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", "", err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return "", "", err
+	}
+	return path, tmp.Name(), nil
+}
+
+// List returns the keys of the regular files that belong to the layout.
+//
+func (s *Storage) List(ctx context.Context) ([]string, error) {
+	var keys []string
+	dirs := []string{""} // slash separated names relative to s.dir
+	for depth := 0; depth <= s.layout.Depth(); depth++ {
+		var next []string
+		for _, dir := range dirs {
+			infos, err := ioutil.ReadDir(filepath.Join(s.dir, filepath.FromSlash(dir)))
+			if err != nil && (depth == 0 || !os.IsNotExist(err)) {
+				return nil, err
+			}
+			for _, info := range infos {
+				name := dir + info.Name()
+				switch {
+				case info.IsDir() && depth < s.layout.Depth():
+					next = append(next, name+"/")
+				case info.Mode().IsRegular() && depth == s.layout.Depth():
+					if key, ok := s.layout.Key(name); ok {
+						keys = append(keys, key)
+					}
+				}
+			}
+		}
+		dirs = next
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Delete removes the file holding key. It won't remove a directory that
+// happens to have the key's file name. Empty shard directories are left.
+//
+func (s *Storage) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+	}
+	return os.Remove(path)
+}
+
+// Stat describes the file holding key. The entity tag is made from its
+// modification time and size, as a webdav server would.
+//
+func (s *Storage) Stat(ctx context.Context, key string) (store.Info, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return store.Info{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return store.Info{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return store.Info{}, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+	return store.Info{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		ETag:    fmt.Sprintf(`"%x%x"`, info.ModTime().UnixNano(), info.Size()),
+	}, nil
+}
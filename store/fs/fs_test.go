@@ -0,0 +1,278 @@
+package fs_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wavemechanics/qdeliver/lookup"
+	"github.com/wavemechanics/qdeliver/store"
+	"github.com/wavemechanics/qdeliver/store/fs"
+	"github.com/wavemechanics/qdeliver/store/layout"
+)
+
+func TestNew(t *testing.T) {
+	if _, err := fs.New("/noexist"); err == nil {
+		t.Fatal("New of missing directory: expected error")
+	}
+	if _, err := fs.New("fs.go"); err == nil {
+		t.Fatal("New of a file: expected error")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestOpen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tests = []struct {
+		url string
+		err error
+	}{
+		{"file://" + dir, nil},
+		{"file://localhost" + dir, nil},
+		{"file:" + dir, nil},
+		{"file://" + strings.TrimPrefix(dir, "/"), fs.ErrRemoteHost},
+		{"file://example.com" + dir, fs.ErrRemoteHost},
+	}
+	for _, test := range tests {
+		_, err := store.Open(test.url, store.Options{Owner: "me", Layout: layout.Default})
+		if !errors.Is(err, test.err) || (err == nil) != (test.err == nil) {
+			t.Errorf("Open(%q): %v, want %v", test.url, err, test.err)
+		}
+	}
+}
+
+func TestKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestKeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := fs.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		key string
+		err error
+	}{
+		{"", store.ErrEmptyKey},
+		{"../escape", store.ErrBadKey},
+		{"sub/key", store.ErrBadKey},
+		{`sub\key`, store.ErrBadKey},
+		{"..", store.ErrBadKey},
+		{"nul\x00", store.ErrBadKey},
+		{"joe-amazon", nil},
+		{"joe.smith", nil},
+	}
+
+	ctx := context.TODO()
+	for _, test := range tests {
+		if err := s.Set(ctx, test.key, "drop"); err != test.err {
+			t.Errorf("Set %q: %v, want %v", test.key, err, test.err)
+		}
+		if _, err := s.Get(ctx, test.key); err != test.err {
+			t.Errorf("Get %q: %v, want %v", test.key, err, test.err)
+		}
+	}
+}
+
+func TestStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestStorage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := fs.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.TODO()
+
+	if _, err = s.Get(ctx, "missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Get missing: %v, want %v", err, os.ErrNotExist)
+	}
+
+	if err = s.Set(ctx, "default", "default value"); err != nil {
+		t.Fatal(err)
+	}
+	contents, created, err := lookup.Lookup(ctx, s, "new")
+	if err != nil || !created {
+		t.Fatalf("Lookup: %v, %v, want created", created, err)
+	}
+	if !strings.Contains(contents, "default value") {
+		t.Fatalf("Lookup contents: %q, want %q", contents, "default value")
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "new.txt"))
+	if err != nil || string(buf) != contents {
+		t.Fatalf("new.txt: %q, %v, want %q", buf, err, contents)
+	}
+
+	// overwrite, and check no temporary files are left behind
+	if err = s.Set(ctx, "new", "drop"); err != nil {
+		t.Fatal(err)
+	}
+	if contents, _ = s.Get(ctx, "new"); contents != "drop" {
+		t.Fatalf("Get after overwrite: %q, want %q", contents, "drop")
+	}
+	ioutil.WriteFile(filepath.Join(dir, "notes.doc"), nil, 0644)
+	os.Mkdir(filepath.Join(dir, "sub.txt"), 0755)
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 4 {
+		t.Fatalf("directory holds %d entries, want 4", len(infos))
+	}
+
+	keys, err := s.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"default", "new"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("List: %q, want %q", keys, want)
+	}
+}
+
+func TestStatDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestStatDelete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := fs.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.TODO()
+
+	if err = s.Set(ctx, "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := s.Stat(ctx, "key")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Size != 5 || info.ModTime.IsZero() || info.ETag == "" {
+		t.Fatalf("Stat: %+v", info)
+	}
+
+	if err = s.Set(ctx, "key", "longer value"); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := s.Stat(ctx, "key"); err != nil || again.ETag == info.ETag {
+		t.Fatalf("Stat after Set: %+v, %v; ETag unchanged", again, err)
+	}
+
+	os.Mkdir(filepath.Join(dir, "sub.txt"), 0755)
+	for _, key := range []string{"missing", "sub"} {
+		if _, err = s.Stat(ctx, key); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Stat %s: %v, want %v", key, err, os.ErrNotExist)
+		}
+	}
+
+	if err = s.Delete(ctx, "key"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err = s.Delete(ctx, "key"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Delete again: %v, want %v", err, os.ErrNotExist)
+	}
+	if err = s.Delete(ctx, "sub"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Delete sub: %v, want %v", err, os.ErrNotExist)
+	}
+	if err = s.Delete(ctx, "../key"); !errors.Is(err, store.ErrBadKey) {
+		t.Fatalf("Delete ../key: %v, want %v", err, store.ErrBadKey)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestCreate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := fs.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.TODO()
+
+	if err = s.Create(ctx, "key", "first"); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err = s.Create(ctx, "key", "second"); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("Create again: %v, want %v", err, os.ErrExist)
+	}
+	if value, _ := s.Get(ctx, "key"); value != "first" {
+		t.Fatalf("Get: %q, want %q", value, "first")
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 {
+		t.Fatalf("directory holds %d entries, want 1", len(infos))
+	}
+}
+
+func TestLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestLayout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := fs.New(dir, fs.WithLayout(layout.Layout{Dir: "me", Shard: 2, Ext: ".conf"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.TODO()
+
+	for _, key := range []string{"me-amazon", "me", "default"} {
+		if err = s.Set(ctx, key, key); err != nil {
+			t.Fatalf("Set %s: %v", key, err)
+		}
+	}
+	if err = s.Create(ctx, "x", "x"); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "me", "m", "me", "me-amazon.conf")); err != nil {
+		t.Fatalf("sharded file: %v", err)
+	}
+	if value, err := s.Get(ctx, "me-amazon"); err != nil || value != "me-amazon" {
+		t.Fatalf("Get: %q, %v", value, err)
+	}
+
+	// files outside the layout are not listed
+	ioutil.WriteFile(filepath.Join(dir, "me", "stray.conf"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "me", "m", "me", "mx.conf"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "me", "m", "me", "me-notes.txt"), nil, 0644)
+
+	keys, err := s.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"default", "me", "me-amazon", "x"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("List: %q, want %q", keys, want)
+	}
+
+	if err = s.Set(ctx, "..x", "value"); !errors.Is(err, store.ErrBadKey) {
+		t.Fatalf("Set ..x: %v, want %v", err, store.ErrBadKey)
+	}
+}
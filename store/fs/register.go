@@ -0,0 +1,38 @@
+package fs
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/wavemechanics/etype"
+	"github.com/wavemechanics/qdeliver/store"
+)
+
+const ErrRemoteHost = etype.Sentinel("URL names a host other than localhost")
+
+func init() {
+	store.Register("file", open)
+}
+
+// Dir returns the local directory named by u, a file: URL or one like it.
+// A host is refused, unless it is localhost, rather than ignored, so that
+// file://var/mail, missing a slash, doesn't name /mail.
+//
+func Dir(u *url.URL) (string, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("%s: %w; use %s:///path for a local directory", u, ErrRemoteHost, u.Scheme)
+	}
+	return u.Path, nil
+}
+
+// open returns the storage for a file: URL, which names a local directory,
+// using the account's layout. The account's login and password are not
+// used.
+//
+func open(u *url.URL, options store.Options) (store.Storage, error) {
+	dir, err := Dir(u)
+	if err != nil {
+		return nil, err
+	}
+	return New(dir, WithLayout(options.Layout))
+}
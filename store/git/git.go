@@ -0,0 +1,453 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/wavemechanics/etype"
+	"github.com/wavemechanics/qdeliver/store"
+	"github.com/wavemechanics/qdeliver/store/fs"
+	"github.com/wavemechanics/qdeliver/store/layout"
+)
+
+const ErrUnknownCommit = etype.Sentinel("no such commit")
+
+// Default author of commits.
+//
+const (
+	DefaultAuthor = "qdeliver"
+	DefaultEmail  = "qdeliver@localhost"
+)
+
+// Storage keeps each key in a file in the working tree of a local git
+// repository, like fs.Storage, and commits every change to it, so the
+// history of a file can be shown and earlier versions restored.
+// Changes are committed with the git command, which must be installed.
+//
+type Storage struct {
+	files      *fs.Storage
+	dir        string
+	layout     layout.Layout
+	author     string
+	email      string
+	untracked  []string
+	companions []string
+	lockfile   string // held while committing
+}
+
+// An Option changes the way a Storage works.
+//
+type Option func(*Storage)
+
+// WithLayout sets how keys are mapped to file names. By default they are
+// layout.Default.
+//
+func WithLayout(l layout.Layout) Option {
+	return func(s *Storage) {
+		s.layout = l
+	}
+}
+
+// WithAuthor sets the author and committer of commits. By default they
+// are DefaultAuthor and DefaultEmail.
+//
+func WithAuthor(name, email string) Option {
+	return func(s *Storage) {
+		s.author = name
+		s.email = email
+	}
+}
+
+// WithUntracked stops changes to keys ending with any of suffixes from
+// being committed, for keys that change too often to keep a history of.
+//
+func WithUntracked(suffixes ...string) Option {
+	return func(s *Storage) {
+		s.untracked = append(s.untracked, suffixes...)
+	}
+}
+
+// WithCompanions makes Rollback restore the keys made by adding each of
+// suffixes to a key, such as the sidecar signature of an address file,
+// along with the key itself and in the same commit, since a file and its
+// companions are only of use together.
+//
+func WithCompanions(suffixes ...string) Option {
+	return func(s *Storage) {
+		s.companions = append(s.companions, suffixes...)
+	}
+}
+
+// New returns a Storage for the existing directory dir. If dir isn't in
+// a git repository, a new repository is created in it.
+//
+func New(dir string, options ...Option) (*Storage, error) {
+	s := &Storage{
+		dir:    dir,
+		layout: layout.Default,
+		author: DefaultAuthor,
+		email:  DefaultEmail,
+	}
+	for _, option := range options {
+		option(s)
+	}
+
+	files, err := fs.New(dir, fs.WithLayout(s.layout))
+	if err != nil {
+		return nil, err
+	}
+	s.files = files
+
+	ctx := context.Background()
+	gitdir, err := s.git(ctx, "rev-parse", "--git-dir")
+	if err != nil {
+		if _, err := s.git(ctx, "init", "--quiet"); err != nil {
+			return nil, err
+		}
+		if gitdir, err = s.git(ctx, "rev-parse", "--git-dir"); err != nil {
+			return nil, err
+		}
+	}
+	gitdir = strings.TrimSpace(gitdir)
+	if !filepath.IsAbs(gitdir) {
+		gitdir = filepath.Join(dir, gitdir)
+	}
+	s.lockfile = filepath.Join(gitdir, LockFile)
+	return s, nil
+}
+
+func (s *Storage) Get(ctx context.Context, key string) (string, error) {
+	return s.files.Get(ctx, key)
+}
+
+// Set stores value under key and commits it.
+//
+func (s *Storage) Set(ctx context.Context, key, value string) error {
+	if err := s.files.Set(ctx, key, value); err != nil {
+		return err
+	}
+	s.record(ctx, "set", key)
+	return nil
+}
+
+// Create stores value under key if key doesn't already exist, and commits it.
+//
+func (s *Storage) Create(ctx context.Context, key, value string) error {
+	if err := s.files.Create(ctx, key, value); err != nil {
+		return err
+	}
+	s.record(ctx, "create", key)
+	return nil
+}
+
+// Delete removes key and commits its removal. Its earlier versions are
+// still in the history.
+//
+func (s *Storage) Delete(ctx context.Context, key string) error {
+	if err := s.files.Delete(ctx, key); err != nil {
+		return err
+	}
+	s.record(ctx, "delete", key)
+	return nil
+}
+
+// record commits a change that has already been made to key's file.
+// The change has happened whether or not it can be committed, and
+// reporting it as failed would make the caller believe otherwise, so an
+// error is only logged; the change goes into the next commit of key.
+//
+func (s *Storage) record(ctx context.Context, verb, key string) {
+	if err := s.commit(ctx, verb, key); err != nil {
+		log.Printf("git: %v; leaving it for the next commit", err)
+	}
+}
+
+func (s *Storage) List(ctx context.Context) ([]string, error) {
+	return s.files.List(ctx)
+}
+
+func (s *Storage) Stat(ctx context.Context, key string) (store.Info, error) {
+	return s.files.Stat(ctx, key)
+}
+
+// A Version is a commit that changed a key.
+//
+type Version struct {
+	Commit  string
+	Author  string // name <email>
+	Time    time.Time
+	Message string
+}
+
+// History returns the commits that changed key, newest first.
+//
+func (s *Storage) History(ctx context.Context, key string) ([]Version, error) {
+	if err := s.check(key); err != nil {
+		return nil, err
+	}
+	out, err := s.git(ctx, "log", "--format=%H%x00%an <%ae>%x00%aI%x00%s", "--", s.layout.Name(key))
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []Version
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.SplitN(line, "\x00", 4)
+		if len(fields) != 4 {
+			continue
+		}
+		t, _ := time.Parse(time.RFC3339, fields[2])
+		versions = append(versions, Version{
+			Commit:  fields[0],
+			Author:  fields[1],
+			Time:    t,
+			Message: fields[3],
+		})
+	}
+	return versions, nil
+}
+
+// GetAt returns the value key had in commit, which may be a commit hash
+// or anything else git accepts, such as "HEAD~2". If key didn't exist
+// then, the error wraps os.ErrNotExist.
+//
+func (s *Storage) GetAt(ctx context.Context, key, commit string) (string, error) {
+	if err := s.check(key); err != nil {
+		return "", err
+	}
+	hash, err := s.resolve(ctx, commit)
+	if err != nil {
+		return "", err
+	}
+	value, err := s.git(ctx, "show", hash+":./"+s.layout.Name(key))
+	if err != nil {
+		return "", fmt.Errorf("%s at %s: %w", key, commit, os.ErrNotExist)
+	}
+	return value, nil
+}
+
+// Rollback restores key to the value it had in commit, and its companions
+// to the values they had while key still had that value, and commits that.
+// Any of them that didn't exist then is deleted.
+//
+func (s *Storage) Rollback(ctx context.Context, key, commit string) error {
+	hash, err := s.resolve(ctx, commit)
+	if err != nil {
+		return err
+	}
+	if err = s.restore(ctx, key, hash); err != nil {
+		return err
+	}
+	keys := []string{key}
+	if len(s.companions) > 0 {
+		at, err := s.companionsAt(ctx, key, hash)
+		if err != nil {
+			return err
+		}
+		for _, suffix := range s.companions {
+			if err = s.restore(ctx, key+suffix, at); err != nil {
+				return err
+			}
+			keys = append(keys, key+suffix)
+		}
+	}
+	return s.commit(ctx, "roll back to "+hash[:12], keys...)
+}
+
+// companionsAt returns the commit holding the companions that went with
+// the value key had in commit. A companion is often written after key, in
+// a commit of its own, so this is the last commit before key next changed.
+//
+func (s *Storage) companionsAt(ctx context.Context, key, commit string) (string, error) {
+	out, err := s.git(ctx, "log", "--reverse", "--format=%H", commit+"..HEAD", "--", s.layout.Name(key))
+	if err != nil {
+		return "", err
+	}
+	if later := strings.Fields(out); len(later) > 0 {
+		return later[0] + "^", nil
+	}
+	return "HEAD", nil
+}
+
+// restore sets key to the value it had in commit, or deletes it if it
+// didn't exist then.
+//
+func (s *Storage) restore(ctx context.Context, key, commit string) error {
+	value, err := s.GetAt(ctx, key, commit)
+	if errors.Is(err, os.ErrNotExist) {
+		err = s.files.Delete(ctx, key)
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+	} else if err == nil {
+		err = s.files.Set(ctx, key, value)
+	}
+	return err
+}
+
+// check returns the error fs.Storage gives for a key it can't store.
+//
+func (s *Storage) check(key string) error {
+	_, err := s.files.Stat(context.Background(), key)
+	if errors.Is(err, store.ErrEmptyKey) || errors.Is(err, store.ErrBadKey) {
+		return err
+	}
+	return nil
+}
+
+// resolve returns the hash of commit.
+//
+func (s *Storage) resolve(ctx context.Context, commit string) (string, error) {
+	if commit == "" || strings.HasPrefix(commit, "-") {
+		return "", fmt.Errorf("%q: %w", commit, ErrUnknownCommit)
+	}
+	out, err := s.git(ctx, "rev-parse", "--verify", "--quiet", commit+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("%q: %w", commit, ErrUnknownCommit)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// LockFile is the file in the git directory that is locked while a
+// change is committed. git add, diff and commit share the index, so the
+// whole sequence must run alone, or a change added by one delivery can be
+// left out of every commit by another's.
+//
+const LockFile = "qdeliver.lock"
+
+// commitAttempts is how many times a commit is tried while something
+// other than qdeliver, such as someone running git by hand, is using the
+// same repository.
+//
+const commitAttempts = 10
+
+// lockPoll is how often lock tries again for a lock another process holds.
+//
+const lockPoll = 10 * time.Millisecond
+
+// lock waits until it holds the lock on s.lockfile, or ctx is done, and
+// returns a function that releases it. The lock is an flock, so it is
+// released if the process dies.
+//
+func (s *Storage) lock(ctx context.Context) (unlock func(), err error) {
+	f, err := os.OpenFile(s.lockfile, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return func() { f.Close() }, nil // closing releases the lock
+		}
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			f.Close()
+			return nil, fmt.Errorf("locking %s: %w", s.lockfile, err)
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(lockPoll):
+		}
+	}
+}
+
+// commit records the current state of the files of keys in one commit,
+// if any of them have changed. The message names the first.
+// Keys with an untracked suffix aren't committed.
+//
+func (s *Storage) commit(ctx context.Context, verb string, keys ...string) error {
+	var names []string
+	for _, key := range keys {
+		if !s.isUntracked(key) {
+			names = append(names, s.layout.Name(key))
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	key := keys[0]
+	message := fmt.Sprintf("%s %s", verb, names[0])
+
+	unlock, err := s.lock(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: committing: %w", key, err)
+	}
+	defer unlock()
+
+	for attempt := 1; attempt <= commitAttempts; attempt++ {
+		if err = s.commitOnce(ctx, names, message); err == nil || !strings.Contains(err.Error(), ".lock") {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * 20 * time.Millisecond):
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: committing: %w", key, err)
+	}
+	return nil
+}
+
+// isUntracked reports whether key has one of the untracked suffixes.
+//
+func (s *Storage) isUntracked(key string) bool {
+	for _, suffix := range s.untracked {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Storage) commitOnce(ctx context.Context, names []string, message string) error {
+	for _, name := range names {
+		args := []string{"add", "--", name}
+		if _, err := os.Lstat(filepath.Join(s.dir, filepath.FromSlash(name))); os.IsNotExist(err) {
+			args = []string{"rm", "--cached", "--ignore-unmatch", "--quiet", "--", name}
+		}
+		if _, err := s.git(ctx, args...); err != nil {
+			return err
+		}
+	}
+	if _, err := s.git(ctx, append([]string{"diff", "--cached", "--quiet", "--"}, names...)...); err == nil {
+		return nil // nothing changed
+	}
+	_, err := s.git(ctx, append([]string{"commit", "--quiet", "--no-verify", "-m", message, "--"}, names...)...)
+	return err
+}
+
+// git runs git in s.dir, returning its standard output.
+// If it fails, the error includes its standard error.
+//
+func (s *Storage) git(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = s.dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME="+s.author,
+		"GIT_AUTHOR_EMAIL="+s.email,
+		"GIT_COMMITTER_NAME="+s.author,
+		"GIT_COMMITTER_EMAIL="+s.email,
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return stdout.String(), nil
+}
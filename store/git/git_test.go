@@ -0,0 +1,260 @@
+package git_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/wavemechanics/qdeliver/lookup"
+	"github.com/wavemechanics/qdeliver/store"
+	"github.com/wavemechanics/qdeliver/store/git"
+	"github.com/wavemechanics/qdeliver/store/layout"
+)
+
+// repo returns a Storage in a new repository, and a function to remove it.
+func repo(t *testing.T, options ...git.Option) (*git.Storage, string, func()) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir, err := ioutil.TempDir("", "git_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := git.New(dir, options...)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, dir, func() { os.RemoveAll(dir) }
+}
+
+// messages returns the subjects of the commits that changed key.
+func messages(t *testing.T, s *git.Storage, key string) []string {
+	versions, err := s.History(context.TODO(), key)
+	if err != nil {
+		t.Fatalf("History(%q): %v", key, err)
+	}
+	var list []string
+	for _, v := range versions {
+		list = append(list, v.Message)
+	}
+	return list
+}
+
+func TestStorage(t *testing.T) {
+	s, dir, cleanup := repo(t, git.WithAuthor("me", "me@example.com"), git.WithUntracked(lookup.CounterSuffix))
+	defer cleanup()
+	ctx := context.TODO()
+
+	if _, err := s.Get(ctx, "missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Get missing: %v, want %v", err, os.ErrNotExist)
+	}
+	if err := s.Set(ctx, "../escape", "drop"); err != store.ErrBadKey {
+		t.Fatalf("Set ../escape: %v, want %v", err, store.ErrBadKey)
+	}
+
+	if err := s.Set(ctx, "default", "forward me@example.com\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, created, err := lookup.Lookup(ctx, s, "new"); err != nil || !created {
+		t.Fatalf("Lookup: %v, %v, want created", created, err)
+	}
+	if err := s.Set(ctx, "new", "drop\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(ctx, "new", "drop\n"); err != nil {
+		t.Fatalf("Set of unchanged value: %v", err)
+	}
+	if err := s.Set(ctx, "new.limit", "{}"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"set new.txt", "create new.txt"}
+	if got := messages(t, s, "new"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("History: %q, want %q", got, want)
+	}
+	if got := messages(t, s, "new.limit"); got != nil {
+		t.Fatalf("History of untracked key: %q, want none", got)
+	}
+
+	versions, _ := s.History(ctx, "new")
+	if versions[0].Author != "me <me@example.com>" || versions[0].Time.IsZero() {
+		t.Fatalf("History: %+v", versions[0])
+	}
+
+	keys, err := s.List(ctx)
+	if want := []string{"default", "new", "new.limit"}; err != nil || !reflect.DeepEqual(keys, want) {
+		t.Fatalf("List: %q, %v, want %q", keys, err, want)
+	}
+
+	out, err := exec.Command("git", "-C", dir, "status", "--porcelain").Output()
+	if err != nil || strings.TrimSpace(string(out)) != "?? new.limit.txt" {
+		t.Fatalf("git status: %q, %v", out, err)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	s, _, cleanup := repo(t)
+	defer cleanup()
+	ctx := context.TODO()
+
+	s.Set(ctx, "a", "one\n")
+	s.Set(ctx, "a", "two\n")
+	s.Set(ctx, "a", "three\n")
+
+	versions, err := s.History(ctx, "a")
+	if err != nil || len(versions) != 3 {
+		t.Fatalf("History: %v, %v", versions, err)
+	}
+	if value, err := s.GetAt(ctx, "a", versions[2].Commit); err != nil || value != "one\n" {
+		t.Fatalf("GetAt first: %q, %v", value, err)
+	}
+	if _, err := s.GetAt(ctx, "a", "--output=/tmp/x"); !errors.Is(err, git.ErrUnknownCommit) {
+		t.Fatalf("GetAt of an option: %v, want %v", err, git.ErrUnknownCommit)
+	}
+	if _, err := s.GetAt(ctx, "b", versions[0].Commit); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("GetAt of missing key: %v, want %v", err, os.ErrNotExist)
+	}
+
+	if err := s.Rollback(ctx, "a", versions[1].Commit); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := s.Get(ctx, "a"); value != "two\n" {
+		t.Fatalf("Get after Rollback: %q, want %q", value, "two\n")
+	}
+	if got := messages(t, s, "a"); len(got) != 4 || !strings.HasPrefix(got[0], "roll back to "+versions[1].Commit[:12]) {
+		t.Fatalf("History after Rollback: %q", got)
+	}
+
+	// rolling back to before the file existed deletes it
+	s.Set(ctx, "b", "drop\n")
+	if err := s.Rollback(ctx, "b", versions[0].Commit); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, "b"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Get after Rollback to before creation: %v, want %v", err, os.ErrNotExist)
+	}
+	if got := messages(t, s, "b"); len(got) != 2 {
+		t.Fatalf("History after deleting Rollback: %q", got)
+	}
+}
+
+// TestCompanions tests that a key's companions are rolled back with it,
+// in the same commit, to the values they had while the key had the value
+// it is rolled back to
+func TestCompanions(t *testing.T) {
+	s, _, cleanup := repo(t, git.WithCompanions(".sig"))
+	defer cleanup()
+	ctx := context.TODO()
+
+	s.Set(ctx, "a", "one\n")
+	s.Set(ctx, "a.sig", "sig one\n")
+	first, err := s.History(ctx, "a.sig")
+	if err != nil || len(first) != 1 {
+		t.Fatalf("History: %v, %v", first, err)
+	}
+	s.Set(ctx, "a", "two\n")
+	s.Set(ctx, "a.sig", "sig two\n")
+
+	if err := s.Rollback(ctx, "a", first[0].Commit); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"a": "one\n", "a.sig": "sig one\n"} {
+		if value, _ := s.Get(ctx, key); value != want {
+			t.Errorf("Get %s after Rollback: %q, want %q", key, value, want)
+		}
+	}
+	a, sig := messages(t, s, "a"), messages(t, s, "a.sig")
+	if len(a) != 3 || len(sig) != 3 || a[0] != sig[0] {
+		t.Fatalf("History after Rollback: %q and %q, want one commit for both", a, sig)
+	}
+
+	// a companion that didn't exist until after the key next changed is
+	// deleted
+	s.Set(ctx, "b", "one\n")
+	versions, _ := s.History(ctx, "b")
+	s.Set(ctx, "b", "two\n")
+	s.Set(ctx, "b.sig", "sig two\n")
+	if err := s.Rollback(ctx, "b", versions[0].Commit); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, "b.sig"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Get b.sig after Rollback: %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+// TestCommitFailure tests that a change that can't be committed is still
+// made, and committed with the next change
+func TestCommitFailure(t *testing.T) {
+	s, dir, cleanup := repo(t)
+	defer cleanup()
+	ctx := context.TODO()
+
+	s.Set(ctx, "first", "drop\n")
+
+	// a directory can't be locked
+	lockfile := filepath.Join(dir, ".git", git.LockFile)
+	os.Remove(lockfile)
+	if err := os.Mkdir(lockfile, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Create(ctx, "a", "one\n"); err != nil {
+		t.Fatalf("Create: %v, want the file written despite the commit failing", err)
+	}
+	if err := s.Create(ctx, "a", "two\n"); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("Create again: %v, want %v", err, os.ErrExist)
+	}
+	if got := messages(t, s, "a"); got != nil {
+		t.Fatalf("History without a lock: %q", got)
+	}
+
+	os.Remove(lockfile)
+	if err := s.Set(ctx, "a", "two\n"); err != nil {
+		t.Fatal(err)
+	}
+	if got := messages(t, s, "a"); len(got) != 1 {
+		t.Fatalf("History after the lock came back: %q", got)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	l := layout.Layout{Ext: ".txt", Shard: 1}
+	s, dir, cleanup := repo(t, git.WithLayout(l))
+	defer cleanup()
+	ctx := context.TODO()
+
+	// a second Storage on the same repository, as in another delivery
+	other, err := git.New(dir, git.WithLayout(l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storages := []*git.Storage{s, other}
+
+	keys := []string{"alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "golf", "hotel"}
+	var wg sync.WaitGroup
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		wg.Add(1)
+		go func(i int, key string) {
+			defer wg.Done()
+			errs[i] = storages[i%2].Create(ctx, key, "drop\n")
+		}(i, key)
+	}
+	wg.Wait()
+
+	for i, key := range keys {
+		if errs[i] != nil {
+			t.Errorf("Create(%q): %v", key, errs[i])
+		}
+		if got := messages(t, s, key); len(got) != 1 || got[0] != "create "+key[:1]+"/"+key+".txt" {
+			t.Errorf("History(%q): %q", key, got)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package git
+
+import (
+	"net/url"
+
+	"github.com/wavemechanics/qdeliver/lookup"
+	"github.com/wavemechanics/qdeliver/store"
+	"github.com/wavemechanics/qdeliver/store/fs"
+	"github.com/wavemechanics/qdeliver/store/signed"
+)
+
+func init() {
+	store.Register("git", open)
+}
+
+// open returns the storage for a git: URL, which names a local directory
+// in a git repository, using the account's layout. Commits are made by
+// the account's owner. The counters of the limit instruction change with
+// every message, so aren't committed, and sidecar signatures are rolled
+// back with their address files.
+//
+func open(u *url.URL, options store.Options) (store.Storage, error) {
+	dir, err := fs.Dir(u)
+	if err != nil {
+		return nil, err
+	}
+	return New(dir,
+		WithLayout(options.Layout),
+		WithAuthor(options.Owner, options.Owner+"@"+options.Domain),
+		WithUntracked(lookup.CounterSuffix),
+		WithCompanions(signed.SigSuffix),
+	)
+}
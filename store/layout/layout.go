@@ -0,0 +1,109 @@
+package layout
+
+import (
+	"net/url"
+	"strings"
+)
+
+// MaxShard is the largest number of shard directories allowed.
+//
+const MaxShard = 4
+
+// A Layout maps keys to file paths within a store, and back.
+//
+// The path of a key is made of, in order:
+//   - Dir, if it isn't empty;
+//   - Shard directories named after the first 1, 2, ... Shard characters
+//     of the key, or the whole key if it is shorter;
+//   - the key itself followed by Ext.
+//
+// The parts are separated by "/". So with Dir "me", Shard 2 and Ext
+// ".txt", the key "amazon" is stored in "me/a/am/amazon.txt".
+//
+type Layout struct {
+	Dir   string
+	Shard int
+	Ext   string
+}
+
+// Default is the layout used when an account doesn't set one: every key
+// is a .txt file in the top directory.
+//
+var Default = Layout{Ext: ".txt"}
+
+// Dirs returns the directories holding key, outermost first.
+//
+func (l Layout) Dirs(key string) []string {
+	var dirs []string
+	if l.Dir != "" {
+		dirs = append(dirs, l.Dir)
+	}
+	runes := []rune(key)
+	for i := 1; i <= l.Shard; i++ {
+		n := i
+		if n > len(runes) {
+			n = len(runes)
+		}
+		dirs = append(dirs, string(runes[:n]))
+	}
+	return dirs
+}
+
+// Name returns the slash separated file name of key, for filesystems.
+//
+func (l Layout) Name(key string) string {
+	return strings.Join(append(l.Dirs(key), key+l.Ext), "/")
+}
+
+// Path returns the file name of key with each element path escaped, for
+// URLs.
+//
+func (l Layout) Path(key string) string {
+	elems := append(l.Dirs(key), key+l.Ext)
+	for i := range elems {
+		elems[i] = url.PathEscape(elems[i])
+	}
+	return strings.Join(elems, "/")
+}
+
+// Valid reports whether key can be stored: it must not be empty, and no
+// element of its file name can be "." or "..", which would name another
+// directory.
+//
+func (l Layout) Valid(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, elem := range append(l.Dirs(key), key+l.Ext) {
+		if elem == "." || elem == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// Depth is the number of directories above every file.
+//
+func (l Layout) Depth() int {
+	if l.Dir != "" {
+		return l.Shard + 1
+	}
+	return l.Shard
+}
+
+// Key returns the key stored in the slash separated file name, which is
+// not escaped. It reports false for names that don't belong to the
+// layout, such as files with another extension, hidden files, or files in
+// the wrong shard directory.
+//
+func (l Layout) Key(name string) (string, bool) {
+	base := name[strings.LastIndexByte(name, '/')+1:]
+	if strings.HasPrefix(base, ".") || !strings.HasSuffix(base, l.Ext) || base == l.Ext {
+		return "", false
+	}
+	key := strings.TrimSuffix(base, l.Ext)
+	if l.Name(key) != name {
+		return "", false
+	}
+	return key, true
+}
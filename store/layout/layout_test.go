@@ -0,0 +1,78 @@
+package layout_test
+
+import (
+	"testing"
+
+	"github.com/wavemechanics/qdeliver/store/layout"
+)
+
+func TestPath(t *testing.T) {
+	var tests = []struct {
+		layout layout.Layout
+		key    string
+		name   string
+		path   string
+	}{
+		{layout.Default, "amazon", "amazon.txt", "amazon.txt"},
+		{layout.Default, "a b", "a b.txt", "a%20b.txt"},
+		{layout.Layout{Ext: ".conf"}, "amazon", "amazon.conf", "amazon.conf"},
+		{layout.Layout{}, "amazon", "amazon", "amazon"},
+		{layout.Layout{Dir: "me", Ext: ".txt"}, "me-amazon", "me/me-amazon.txt", "me/me-amazon.txt"},
+		{layout.Layout{Shard: 2, Ext: ".txt"}, "amazon", "a/am/amazon.txt", "a/am/amazon.txt"},
+		{layout.Layout{Shard: 3, Ext: ".txt"}, "ab", "a/ab/ab/ab.txt", "a/ab/ab/ab.txt"},
+		{layout.Layout{Shard: 2, Ext: ".txt"}, "é b", "é/é /é b.txt", "%C3%A9/%C3%A9%20/%C3%A9%20b.txt"},
+		{layout.Layout{Dir: "me", Shard: 1}, "me", "me/m/me", "me/m/me"},
+	}
+
+	for _, test := range tests {
+		if name := test.layout.Name(test.key); name != test.name {
+			t.Errorf("%+v: Name(%q) = %q, want %q", test.layout, test.key, name, test.name)
+		}
+		if path := test.layout.Path(test.key); path != test.path {
+			t.Errorf("%+v: Path(%q) = %q, want %q", test.layout, test.key, path, test.path)
+		}
+		if key, ok := test.layout.Key(test.name); !ok || key != test.key {
+			t.Errorf("%+v: Key(%q) = %q, %v, want %q", test.layout, test.name, key, ok, test.key)
+		}
+	}
+}
+
+func TestKey(t *testing.T) {
+	sharded := layout.Layout{Shard: 2, Ext: ".txt"}
+
+	var tests = []struct {
+		layout layout.Layout
+		name   string
+	}{
+		{layout.Default, "notes.doc"},
+		{layout.Default, ".txt"},
+		{layout.Default, ".tmp-123.txt"},
+		{layout.Default, "sub/amazon.txt"},
+		{sharded, "amazon.txt"},
+		{sharded, "a/ab/amazon.txt"},
+		{sharded, "b/am/amazon.txt"},
+		{layout.Layout{}, ".tmp-123"},
+	}
+
+	for _, test := range tests {
+		if key, ok := test.layout.Key(test.name); ok {
+			t.Errorf("%+v: Key(%q) = %q, want not ok", test.layout, test.name, key)
+		}
+	}
+}
+
+func TestValid(t *testing.T) {
+	sharded := layout.Layout{Shard: 2, Ext: ".txt"}
+
+	for _, key := range []string{"", ".", "..", "..x"} {
+		if sharded.Valid(key) {
+			t.Errorf("Valid(%q) = true, want false", key)
+		}
+	}
+	if !layout.Default.Valid("..x") {
+		t.Errorf("unsharded: Valid(%q) = false, want true", "..x")
+	}
+	if (layout.Layout{}).Valid("..") {
+		t.Errorf("no extension: Valid(%q) = true, want false", "..")
+	}
+}
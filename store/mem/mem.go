@@ -2,28 +2,338 @@ package mem
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/wavemechanics/qdeliver/store"
 )
 
+// Storage keeps values in memory. The zero value is an empty Storage
+// ready to use, and it is safe for concurrent use.
+//
+// For tests of code built on it, a Storage can be made slow or failing
+// with Inject, and it records every call made to it; see Calls.
+//
 type Storage struct {
-	m map[string]string
+	mu      sync.Mutex
+	m       map[string]entry
+	version int64 // bumped on every Set, to make entity tags
+	faults  []*fault
+	calls   []Call
 }
 
-func (s *Storage) Get(ctx context.Context, key string) (string, error) {
-	if s.m == nil {
-		s.m = make(map[string]string)
+// entry is one stored value.
+//
+type entry struct {
+	value   string
+	modTime time.Time
+	version int64
+}
+
+// An Op names a Storage method.
+//
+type Op string
+
+const (
+	OpGet        Op = "Get"
+	OpSet        Op = "Set"
+	OpList       Op = "List"
+	OpDelete     Op = "Delete"
+	OpStat       Op = "Stat"
+	OpGetVersion Op = "GetVersion"
+	OpSetIf      Op = "SetIf"
+	OpCreate     Op = "Create"
+)
+
+// A Call is a method call recorded by a Storage. Value is only set for
+// the methods that store a value, and Err is what the call returned.
+//
+type Call struct {
+	Op    Op
+	Key   string
+	Value string
+	Err   error
+}
+
+// A Fault changes what some calls to a Storage do.
+// Op and Key pick the calls it applies to; if either is empty, it
+// matches any. If Nth is more than zero, only the Nth matching call is
+// changed, counting from 1. A changed call waits for Delay, or until its
+// context is done, and then returns Err instead of doing anything, if
+// Err isn't nil.
+//
+type Fault struct {
+	Op    Op
+	Key   string
+	Nth   int
+	Delay time.Duration
+	Err   error
+}
+
+// fault is an injected Fault, and how many calls it has matched.
+//
+type fault struct {
+	Fault
+	count int
+}
+
+// Inject adds f to the faults applied to calls to s.
+//
+func (s *Storage) Inject(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &fault{Fault: f})
+}
+
+// FailNth makes the nth call of op return err.
+//
+func (s *Storage) FailNth(op Op, n int, err error) {
+	s.Inject(Fault{Op: op, Nth: n, Err: err})
+}
+
+// Delay makes every call of op wait for d first.
+//
+func (s *Storage) Delay(op Op, d time.Duration) {
+	s.Inject(Fault{Op: op, Delay: d})
+}
+
+// FailKey makes every call for key return err.
+//
+func (s *Storage) FailKey(key string, err error) {
+	s.Inject(Fault{Key: key, Err: err})
+}
+
+// ClearFaults removes all injected faults.
+//
+func (s *Storage) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// Calls returns the calls made to s so far, in the order they finished.
+//
+func (s *Storage) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// ClearCalls forgets the calls made to s so far.
+//
+func (s *Storage) ClearCalls() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = nil
+}
+
+// begin applies the faults matching a call of op for key, returning the
+// error the call should return instead, if any.
+//
+func (s *Storage) begin(ctx context.Context, op Op, key string) error {
+	var delay time.Duration
+	var err error
+
+	s.mu.Lock()
+	for _, f := range s.faults {
+		if f.Op != "" && f.Op != op || f.Key != "" && f.Key != key {
+			continue
+		}
+		f.count++
+		if f.Nth > 0 && f.count != f.Nth {
+			continue
+		}
+		delay += f.Delay
+		if err == nil {
+			err = f.Err
+		}
 	}
-	val, ok := s.m[key]
+	s.mu.Unlock()
+
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return err
+}
+
+// end records a call.
+//
+func (s *Storage) end(op Op, key, value string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, Call{Op: op, Key: key, Value: value, Err: err})
+}
+
+func (s *Storage) Get(ctx context.Context, key string) (value string, err error) {
+	defer func() { s.end(OpGet, key, "", err) }()
+	if key == "" {
+		return "", store.ErrEmptyKey
+	}
+	if err = s.begin(ctx, OpGet, key); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.m[key]
 	if !ok {
 		return "", os.ErrNotExist
 	}
-	return val, nil
+	return e.value, nil
+}
+
+func (s *Storage) Set(ctx context.Context, key, value string) (err error) {
+	defer func() { s.end(OpSet, key, value, err) }()
+	if key == "" {
+		return store.ErrEmptyKey
+	}
+	if err = s.begin(ctx, OpSet, key); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(key, value)
+	return nil
 }
 
-func (s *Storage) Set(ctx context.Context, key, value string) error {
+// set stores value under key. s.mu must be held.
+//
+func (s *Storage) set(key, value string) {
 	if s.m == nil {
-		s.m = make(map[string]string)
+		s.m = make(map[string]entry)
+	}
+	s.version++
+	s.m[key] = entry{
+		value:   value,
+		modTime: time.Now(),
+		version: s.version,
+	}
+}
+
+func (s *Storage) List(ctx context.Context) (keys []string, err error) {
+	defer func() { s.end(OpList, "", "", err) }()
+	if err = s.begin(ctx, OpList, ""); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys = make([]string, 0, len(s.m))
+	for key := range s.m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *Storage) Delete(ctx context.Context, key string) (err error) {
+	defer func() { s.end(OpDelete, key, "", err) }()
+	if key == "" {
+		return store.ErrEmptyKey
+	}
+	if err = s.begin(ctx, OpDelete, key); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.m[key]; !ok {
+		return os.ErrNotExist
+	}
+	delete(s.m, key)
+	return nil
+}
+
+func (s *Storage) Stat(ctx context.Context, key string) (info store.Info, err error) {
+	defer func() { s.end(OpStat, key, "", err) }()
+	if key == "" {
+		return store.Info{}, store.ErrEmptyKey
+	}
+	if err = s.begin(ctx, OpStat, key); err != nil {
+		return store.Info{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.m[key]
+	if !ok {
+		return store.Info{}, os.ErrNotExist
+	}
+	return store.Info{
+		Size:    int64(len(e.value)),
+		ModTime: e.modTime,
+		ETag:    e.etag(),
+	}, nil
+}
+
+// etag returns the entity tag for e, which changes every time it is Set.
+//
+func (e entry) etag() string {
+	return strconv.Quote(strconv.FormatInt(e.version, 10))
+}
+
+func (s *Storage) GetVersion(ctx context.Context, key string) (value string, rev store.Revision, err error) {
+	defer func() { s.end(OpGetVersion, key, "", err) }()
+	if key == "" {
+		return "", store.Revision{}, store.ErrEmptyKey
+	}
+	if err = s.begin(ctx, OpGetVersion, key); err != nil {
+		return "", store.Revision{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.m[key]
+	if !ok {
+		return "", store.Revision{}, os.ErrNotExist
+	}
+	return e.value, store.Revision{ETag: e.etag()}, nil
+}
+
+func (s *Storage) SetIf(ctx context.Context, key, value string, rev store.Revision) (err error) {
+	defer func() { s.end(OpSetIf, key, value, err) }()
+	if key == "" {
+		return store.ErrEmptyKey
+	}
+	if err = s.begin(ctx, OpSetIf, key); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.m[key]
+	if !ok || rev.ETag != e.etag() {
+		return fmt.Errorf("%s: %w", key, store.ErrConflict)
+	}
+	s.set(key, value)
+	return nil
+}
+
+func (s *Storage) Create(ctx context.Context, key, value string) (err error) {
+	defer func() { s.end(OpCreate, key, value, err) }()
+	if key == "" {
+		return store.ErrEmptyKey
+	}
+	if err = s.begin(ctx, OpCreate, key); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.m[key]; ok {
+		return fmt.Errorf("%s: %w", key, os.ErrExist)
 	}
-	s.m[key] = value
+	s.set(key, value)
 	return nil
 }
@@ -0,0 +1,163 @@
+package mem_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wavemechanics/qdeliver/lookup"
+	"github.com/wavemechanics/qdeliver/store"
+	"github.com/wavemechanics/qdeliver/store/mem"
+)
+
+func TestSetIf(t *testing.T) {
+	var s mem.Storage
+	ctx := context.TODO()
+
+	if err := s.SetIf(ctx, "key", "value", store.Revision{}); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("SetIf missing: %v, want %v", err, store.ErrConflict)
+	}
+
+	s.Set(ctx, "key", "one")
+	value, rev, err := s.GetVersion(ctx, "key")
+	if err != nil || value != "one" || rev.ETag == "" {
+		t.Fatalf("GetVersion: %q, %+v, %v", value, rev, err)
+	}
+	if err = s.SetIf(ctx, "key", "two", rev); err != nil {
+		t.Fatalf("SetIf: %v", err)
+	}
+	if err = s.SetIf(ctx, "key", "three", rev); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("SetIf stale: %v, want %v", err, store.ErrConflict)
+	}
+	if value, _ = s.Get(ctx, "key"); value != "two" {
+		t.Fatalf("Get: %q, want %q", value, "two")
+	}
+
+	_, rev, _ = s.GetVersion(ctx, "key")
+	s.Delete(ctx, "key")
+	if err = s.SetIf(ctx, "key", "four", rev); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("SetIf deleted: %v, want %v", err, store.ErrConflict)
+	}
+}
+
+// TestKeys tests that an empty key is refused, and that creating a key
+// that exists fails as it does in other storage
+func TestKeys(t *testing.T) {
+	var s mem.Storage
+	ctx := context.TODO()
+
+	if _, err := s.Get(ctx, ""); err != store.ErrEmptyKey {
+		t.Fatalf("Get empty key: %v, want %v", err, store.ErrEmptyKey)
+	}
+	if err := s.Set(ctx, "", "value"); err != store.ErrEmptyKey {
+		t.Fatalf("Set empty key: %v, want %v", err, store.ErrEmptyKey)
+	}
+	if err := s.Create(ctx, "", "value"); err != store.ErrEmptyKey {
+		t.Fatalf("Create empty key: %v, want %v", err, store.ErrEmptyKey)
+	}
+	if keys, _ := s.List(ctx); len(keys) != 0 {
+		t.Fatalf("List: %q, want none", keys)
+	}
+
+	s.Create(ctx, "key", "one")
+	err := s.Create(ctx, "key", "two")
+	if !errors.Is(err, os.ErrExist) || !strings.HasPrefix(err.Error(), "key: ") {
+		t.Fatalf("Create existing key: %v, want key: %v", err, os.ErrExist)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	var s mem.Storage
+	ctx := context.TODO()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key%d", i%5)
+			s.Set(ctx, key, "value")
+			s.Get(ctx, key)
+			s.Create(ctx, key, "value")
+			s.List(ctx)
+		}(i)
+	}
+	wg.Wait()
+
+	if n := len(s.Calls()); n != 80 {
+		t.Fatalf("%d calls recorded, want 80", n)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	var s mem.Storage
+	ctx := context.TODO()
+	errDown := errors.New("503 Service Unavailable")
+	s.Set(ctx, "a", "A")
+	s.Set(ctx, "b", "B")
+
+	s.FailNth(mem.OpGet, 2, errDown)
+	for i, want := range []error{nil, errDown, nil} {
+		if _, err := s.Get(ctx, "a"); err != want {
+			t.Errorf("Get %d: %v, want %v", i+1, err, want)
+		}
+	}
+
+	s.FailKey("b", errDown)
+	if _, err := s.Get(ctx, "b"); err != errDown {
+		t.Errorf("Get of failing key: %v, want %v", err, errDown)
+	}
+	if err := s.Set(ctx, "b", "new"); err != errDown {
+		t.Errorf("Set of failing key: %v, want %v", err, errDown)
+	}
+	s.ClearFaults()
+	if value, err := s.Get(ctx, "b"); err != nil || value != "B" {
+		t.Errorf("Get after ClearFaults: %q, %v, want %q", value, err, "B")
+	}
+
+	s.Delay(mem.OpSet, time.Hour)
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := s.Set(short, "a", "late"); err != context.DeadlineExceeded {
+		t.Errorf("delayed Set: %v, want %v", err, context.DeadlineExceeded)
+	}
+	if value, _ := s.Get(ctx, "a"); value != "A" {
+		t.Errorf("Get after timed out Set: %q, want %q", value, "A")
+	}
+}
+
+func TestCalls(t *testing.T) {
+	var s mem.Storage
+	ctx := context.TODO()
+	s.Set(ctx, "default", "drop")
+	s.ClearCalls()
+
+	if _, created, err := lookup.Lookup(ctx, &s, "new"); err != nil || !created {
+		t.Fatalf("Lookup: %v, %v", created, err)
+	}
+
+	var ops []mem.Op
+	for _, call := range s.Calls() {
+		ops = append(ops, call.Op)
+	}
+	want := []mem.Op{mem.OpGet, mem.OpGet, mem.OpCreate}
+	if !reflect.DeepEqual(ops, want) {
+		t.Fatalf("calls: %v, want %v", ops, want)
+	}
+	calls := s.Calls()
+	if calls[0].Key != "new" || !errors.Is(calls[0].Err, os.ErrNotExist) || calls[2].Key != "new" || !strings.HasPrefix(calls[2].Value, "drop") {
+		t.Fatalf("calls: %+v", calls)
+	}
+
+	// a failed write is passed back to the caller
+	s.FailNth(mem.OpCreate, 1, errors.New("507 Insufficient Storage"))
+	if _, _, err := lookup.Lookup(ctx, &s, "other"); err == nil {
+		t.Fatal("Lookup with failing Create: expected error")
+	}
+}
@@ -0,0 +1,39 @@
+package mem
+
+import (
+	"net/url"
+	"sync"
+
+	"github.com/wavemechanics/qdeliver/store"
+)
+
+func init() {
+	store.Register("mem", open)
+}
+
+var (
+	namedMu sync.Mutex
+	named   = make(map[string]*Storage)
+)
+
+// Named returns the Storage called name, creating it if it doesn't exist.
+// Every mem://name URL opens the same Storage, so tests can fill it in
+// before running code that finds it through the user database.
+//
+func Named(name string) *Storage {
+	namedMu.Lock()
+	defer namedMu.Unlock()
+
+	s, ok := named[name]
+	if !ok {
+		s = &Storage{}
+		named[name] = s
+	}
+	return s
+}
+
+// open returns the Storage named by the host part of a mem: URL.
+//
+func open(u *url.URL, options store.Options) (store.Storage, error) {
+	return Named(u.Host), nil
+}
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wavemechanics/etype"
+	"github.com/wavemechanics/qdeliver/store/layout"
+)
+
+const ErrUnknownScheme = etype.Sentinel("no storage for URL scheme")
+
+// An Opener returns the storage named by u, using any of options it needs.
+//
+type Opener func(u *url.URL, options Options) (Storage, error)
+
+// Options are the settings of the account whose storage is opened.
+// Owner and Domain say whose it is, Login and Password how to log in, and
+// Layout how keys are mapped to file names. Retry, Auth and TLS are only
+// used by backends that make network requests, and may be nil.
+//
+type Options struct {
+	Owner    string
+	Domain   string
+	Login    string
+	Password string
+	Layout   layout.Layout
+	Retry    *Retry
+	Auth     *Auth
+	TLS      *TLS
+}
+
+// Retry says how many times requests that fail temporarily are tried, and
+// how long to wait between tries.
+//
+type Retry struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Auth says how to authenticate to a server. Mode is "basic", "digest",
+// "bearer" or "cert", and Cert and Key name PEM files holding a client
+// certificate and its private key.
+//
+type Auth struct {
+	Mode string
+	Cert string
+	Key  string
+}
+
+// TLS holds the settings for TLS connections: CA names a PEM file of
+// certificate authorities, Pin is a base64 SHA-256 hash of a public key
+// the server's chain must include, and MinVersion is the oldest TLS
+// version allowed, such as "1.2".
+//
+type TLS struct {
+	CA         string
+	Pin        string
+	MinVersion string
+}
+
+var (
+	openersMu sync.RWMutex
+	openers   = make(map[string]Opener)
+)
+
+// Register makes a storage backend available for URLs with scheme.
+// It is meant to be called from the backend's init function, and panics
+// if scheme is registered twice.
+//
+func Register(scheme string, open Opener) {
+	openersMu.Lock()
+	defer openersMu.Unlock()
+
+	scheme = strings.ToLower(scheme)
+	if _, dup := openers[scheme]; dup {
+		panic("store: Register called twice for scheme " + scheme)
+	}
+	openers[scheme] = open
+}
+
+// Schemes returns the registered URL schemes in sorted order.
+//
+func Schemes() []string {
+	openersMu.RLock()
+	defer openersMu.RUnlock()
+
+	var schemes []string
+	for scheme := range openers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open returns the storage named by rawurl, using the backend registered
+// for its scheme.
+//
+func Open(rawurl string, options Options) (Storage, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	openersMu.RLock()
+	open, ok := openers[strings.ToLower(u.Scheme)]
+	openersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%s: %w %q", rawurl, ErrUnknownScheme, u.Scheme)
+	}
+	return open(u, options)
+}
@@ -0,0 +1,76 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/wavemechanics/qdeliver/store"
+)
+
+// fake is a Storage that remembers how it was opened.
+type fake struct {
+	url   string
+	login string
+}
+
+func (f *fake) Get(ctx context.Context, key string) (string, error) { return f.url, nil }
+func (f *fake) Set(ctx context.Context, key, value string) error    { return nil }
+
+func TestRegistry(t *testing.T) {
+	errCantOpen := errors.New("can't open")
+	store.Register("test", func(u *url.URL, options store.Options) (store.Storage, error) {
+		if u.Host == "fail" {
+			return nil, errCantOpen
+		}
+		return &fake{url: u.String(), login: options.Login}, nil
+	})
+
+	var tests = []struct {
+		url string
+		err error
+	}{
+		{"test://host/path", nil},
+		{"TEST://host/path", nil}, // schemes are case insensitive
+		{"test://fail", errCantOpen},
+		{"nosuch://host/path", store.ErrUnknownScheme},
+		{"relative/path", store.ErrUnknownScheme},
+	}
+
+	for _, test := range tests {
+		s, err := store.Open(test.url, store.Options{Login: "login"})
+		if test.err != nil {
+			if !errors.Is(err, test.err) {
+				t.Errorf("%s: %v, want %v", test.url, err, test.err)
+			}
+			if s != nil {
+				t.Errorf("%s: storage returned with error", test.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.url, err)
+			continue
+		}
+		f, ok := s.(*fake)
+		if !ok || f.login != "login" {
+			t.Errorf("%s: opened %#v", test.url, s)
+		}
+	}
+
+	found := false
+	for _, scheme := range store.Schemes() {
+		found = found || scheme == "test"
+	}
+	if !found {
+		t.Errorf("Schemes: %q does not include test", store.Schemes())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a scheme twice did not panic")
+		}
+	}()
+	store.Register("test", nil)
+}
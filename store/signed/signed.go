@@ -0,0 +1,156 @@
+package signed
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/wavemechanics/qdeliver/sign"
+	"github.com/wavemechanics/qdeliver/store"
+)
+
+// SigSuffix is added to the key of a file to make the key of its sidecar
+// signature.
+//
+const SigSuffix = ".sig"
+
+// Storage wraps another Storage, only returning values that carry a valid
+// signature made with the private half of key. The signature is either
+// embedded in the value as a trailer, or kept in a sidecar under the
+// value's key plus SigSuffix.
+//
+// Values written must have been read through the same Storage, or carry
+// a valid trailer, so copying the default file to a new address keeps it
+// signed. A sidecar is written along with a copy that needs one.
+//
+type Storage struct {
+	backend store.Storage
+	key     ed25519.PublicKey
+
+	mu       sync.Mutex
+	verified map[string]string // body to sidecar signature
+}
+
+// New returns a Storage verifying values from backend with key.
+//
+func New(backend store.Storage, key ed25519.PublicKey) *Storage {
+	return &Storage{
+		backend:  backend,
+		key:      key,
+		verified: make(map[string]string),
+	}
+}
+
+// Verbatim marks Storage as one whose copies must not be changed, since
+// they would no longer match their signatures.
+//
+func (s *Storage) Verbatim() {}
+
+// Get returns the value of key if its signature is valid.
+// An unsigned or tampered value returns an error wrapping sign.ErrUnsigned
+// or sign.ErrBadSignature.
+//
+func (s *Storage) Get(ctx context.Context, key string) (string, error) {
+	value, err := s.backend.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	sig, embedded := sign.Trailer(value)
+	if !embedded {
+		sig, err = s.backend.Get(ctx, key+SigSuffix)
+		if errors.Is(err, os.ErrNotExist) {
+			sig, err = "", nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("%s: reading signature: %v", key, err)
+		}
+	}
+	if err := sign.Verify(value, sig, s.key); err != nil {
+		return "", fmt.Errorf("%s: %w", key, err)
+	}
+
+	if !embedded {
+		s.mu.Lock()
+		s.verified[sign.Body(value)] = sig
+		s.mu.Unlock()
+	}
+	return value, nil
+}
+
+func (s *Storage) Set(ctx context.Context, key, value string) error {
+	sig, err := s.sidecar(key, value)
+	if err != nil {
+		return err
+	}
+	if err := s.backend.Set(ctx, key, value); err != nil {
+		return err
+	}
+	return s.setSidecar(ctx, key, sig)
+}
+
+// Create is like Set, but only stores value if key doesn't exist.
+// A sidecar signature is written after the value, so it can't replace the
+// signature of a value someone else created first.
+//
+func (s *Storage) Create(ctx context.Context, key, value string) error {
+	sig, err := s.sidecar(key, value)
+	if err != nil {
+		return err
+	}
+	if err := store.Create(ctx, s.backend, key, value); err != nil {
+		return err
+	}
+	return s.setSidecar(ctx, key, sig)
+}
+
+// List returns the keys in the backend, without the sidecars.
+//
+func (s *Storage) List(ctx context.Context) ([]string, error) {
+	lister, ok := s.backend.(store.Lister)
+	if !ok {
+		return nil, errors.New("storage cannot list keys")
+	}
+	keys, err := lister.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	for _, key := range keys {
+		if !strings.HasSuffix(key, SigSuffix) {
+			list = append(list, key)
+		}
+	}
+	return list, nil
+}
+
+// sidecar returns the signature that must be written to key's sidecar
+// along with value, or "" if value carries its own.
+//
+func (s *Storage) sidecar(key, value string) (string, error) {
+	if sig, ok := sign.Trailer(value); ok {
+		if err := sign.Verify(value, sig, s.key); err != nil {
+			return "", fmt.Errorf("%s: %w", key, err)
+		}
+		return "", nil
+	}
+
+	s.mu.Lock()
+	sig, ok := s.verified[sign.Body(value)]
+	s.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("%s: %w", key, sign.ErrUnsigned)
+	}
+	return sig, nil
+}
+
+func (s *Storage) setSidecar(ctx context.Context, key, sig string) error {
+	if sig == "" {
+		return nil
+	}
+	return s.backend.Set(ctx, key+SigSuffix, sig+"\n")
+}
@@ -0,0 +1,97 @@
+package signed_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wavemechanics/qdeliver/lookup"
+	"github.com/wavemechanics/qdeliver/sign"
+	"github.com/wavemechanics/qdeliver/store/mem"
+	"github.com/wavemechanics/qdeliver/store/signed"
+)
+
+var priv = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+var pub = priv.Public().(ed25519.PublicKey)
+
+func TestGet(t *testing.T) {
+	ctx := context.TODO()
+	backend := &mem.Storage{}
+	contents := "forward me@example.com\n"
+	backend.Set(ctx, "embedded", sign.Embed(contents, priv))
+	backend.Set(ctx, "sidecar", contents)
+	backend.Set(ctx, "sidecar.sig", sign.Sign(contents, priv)+"\n")
+	backend.Set(ctx, "unsigned", contents)
+	backend.Set(ctx, "tampered", strings.Replace(sign.Embed(contents, priv), "me@", "thief@", 1))
+
+	var tests = []struct {
+		key string
+		err error
+	}{
+		{"embedded", nil},
+		{"sidecar", nil},
+		{"unsigned", sign.ErrUnsigned},
+		{"tampered", sign.ErrBadSignature},
+	}
+	s := signed.New(backend, pub)
+	for _, test := range tests {
+		_, err := s.Get(ctx, test.key)
+		if !errors.Is(err, test.err) || (err == nil) != (test.err == nil) {
+			t.Errorf("Get(%q): %v, want %v", test.key, err, test.err)
+		}
+	}
+
+	keys, err := s.List(ctx)
+	want := []string{"embedded", "sidecar", "tampered", "unsigned"}
+	if err != nil || !reflect.DeepEqual(keys, want) {
+		t.Fatalf("List: %q, %v, want %q", keys, err, want)
+	}
+}
+
+func TestSet(t *testing.T) {
+	ctx := context.TODO()
+	backend := &mem.Storage{}
+	s := signed.New(backend, pub)
+
+	if err := s.Set(ctx, "a", "forward me@example.com\n"); !errors.Is(err, sign.ErrUnsigned) {
+		t.Fatalf("Set of unsigned value: %v, want %v", err, sign.ErrUnsigned)
+	}
+	if err := s.Set(ctx, "a", sign.Embed("forward me@example.com\n", priv)); err != nil {
+		t.Fatalf("Set of signed value: %v", err)
+	}
+	if _, err := backend.Get(ctx, "a.sig"); err == nil {
+		t.Fatal("Set wrote a sidecar for a value with a trailer")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	ctx := context.TODO()
+	contents := "expires +30d\nforward me@example.com\n"
+
+	for _, embed := range []bool{false, true} {
+		backend := &mem.Storage{}
+		if embed {
+			backend.Set(ctx, lookup.Default, sign.Embed(contents, priv))
+		} else {
+			backend.Set(ctx, lookup.Default, contents)
+			backend.Set(ctx, lookup.Default+signed.SigSuffix, sign.Sign(contents, priv))
+		}
+
+		s := signed.New(backend, pub)
+		got, created, err := lookup.Lookup(ctx, s, "new")
+		if err != nil || !created {
+			t.Fatalf("embed %v: Lookup: %v, %v", embed, created, err)
+		}
+		if !strings.HasPrefix(got, contents) {
+			t.Fatalf("embed %v: Lookup changed the copy: %q", embed, got)
+		}
+
+		// a fresh Storage has to verify the copy from scratch
+		if _, err := signed.New(backend, pub).Get(ctx, "new"); err != nil {
+			t.Fatalf("embed %v: Get of copy: %v", embed, err)
+		}
+	}
+}
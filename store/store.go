@@ -2,13 +2,143 @@ package store
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
 
 	"github.com/wavemechanics/etype"
 )
 
-const ErrEmptyKey = etype.Sentinel("empty key not allowed")
+const (
+	ErrEmptyKey = etype.Sentinel("empty key not allowed")
+	ErrBadKey   = etype.Sentinel("key not allowed")
+)
 
 type Storage interface {
 	Get(ctx context.Context, key string) (string, error)
 	Set(ctx context.Context, key, value string) error
 }
+
+// A Lister is a Storage that can list the keys it holds.
+// Keys are returned in sorted order.
+//
+type Lister interface {
+	Storage
+	List(ctx context.Context) ([]string, error)
+}
+
+// A Deleter is a Storage that can remove keys.
+// Deleting a key that doesn't exist returns an error wrapping os.ErrNotExist.
+//
+type Deleter interface {
+	Storage
+	Delete(ctx context.Context, key string) error
+}
+
+// A Creator is a Storage that can store a value only if its key doesn't
+// already exist, as one atomic step.
+// Creating a key that exists returns an error wrapping os.ErrExist.
+//
+type Creator interface {
+	Storage
+	Create(ctx context.Context, key, value string) error
+}
+
+// Create stores value under key if key doesn't already exist.
+// If s is a Creator, this is atomic. Otherwise key is checked with Get
+// before the Set, so another writer could still create it in between.
+//
+func Create(ctx context.Context, s Storage, key, value string) error {
+	if c, ok := s.(Creator); ok {
+		return c.Create(ctx, key, value)
+	}
+	_, err := s.Get(ctx, key)
+	if err == nil {
+		return fmt.Errorf("%s: %w", key, os.ErrExist)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return s.Set(ctx, key, value)
+}
+
+// Info describes a stored value. ETag is empty if the backend has no
+// entity tags.
+//
+type Info struct {
+	Size    int64
+	ModTime time.Time
+	ETag    string
+}
+
+// A Stater is a Storage that can describe a value without fetching it.
+// Stat of a key that doesn't exist returns an error wrapping os.ErrNotExist.
+//
+type Stater interface {
+	Storage
+	Stat(ctx context.Context, key string) (Info, error)
+}
+
+const ErrUnavailable = etype.Sentinel("storage unavailable")
+
+// Unavailable marks err as meaning the storage couldn't be reached, such
+// as a network error or a server that is down for a while, as opposed to
+// one that answered with a refusal. errors.Is(err, ErrUnavailable) is true
+// of the result, and err can still be found in it with errors.Is and
+// errors.As.
+//
+func Unavailable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &unavailableError{err}
+}
+
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string        { return e.err.Error() }
+func (e *unavailableError) Unwrap() error        { return e.err }
+func (e *unavailableError) Is(target error) bool { return target == ErrUnavailable }
+
+const ErrNotModified = etype.Sentinel("not modified")
+
+// A Revision identifies one version of a stored value, such as an HTTP
+// entity tag or modification time. The zero Revision matches nothing.
+//
+type Revision struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// A Revalidator is a Storage that can avoid fetching a value again if it
+// hasn't changed since it was last fetched.
+//
+type Revalidator interface {
+	Storage
+
+	// GetIfChanged is like Get, but returns ErrNotModified if the value
+	// is still at revision rev. Otherwise it returns the value and its
+	// current revision.
+	GetIfChanged(ctx context.Context, key string, rev Revision) (string, Revision, error)
+}
+
+const ErrConflict = etype.Sentinel("changed since it was read")
+
+// A Versioner is a Storage that supports optimistic concurrency: a value
+// read with GetVersion can be written back with SetIf, which fails if
+// anyone else has changed it in the meantime.
+//
+type Versioner interface {
+	Storage
+
+	// GetVersion is like Get, but also returns the value's revision.
+	GetVersion(ctx context.Context, key string) (string, Revision, error)
+
+	// SetIf stores value only if key is still at revision rev.
+	// Otherwise, including when key has been deleted, it returns an
+	// error wrapping ErrConflict.
+	SetIf(ctx context.Context, key, value string, rev Revision) error
+}
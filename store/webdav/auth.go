@@ -0,0 +1,240 @@
+package webdav
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// An Authenticator adds credentials to requests.
+//
+type Authenticator interface {
+	// Authorize adds credentials to req before it is sent.
+	Authorize(req *http.Request) error
+
+	// Challenge is given a 401 response, and reports whether the
+	// request should be sent again with new credentials.
+	Challenge(resp *http.Response) bool
+}
+
+// WithAuth sets how requests are authenticated. By default they use HTTP
+// Basic authentication with the login and password given to New.
+//
+func WithAuth(auth Authenticator) Option {
+	return func(s *Storage) {
+		s.auth = auth
+	}
+}
+
+// WithClientCert presents cert to the server when making TLS connections.
+// It can be used with any Authenticator, or with NoAuth.
+//
+func WithClientCert(cert tls.Certificate) Option {
+	return func(s *Storage) {
+		c := s.tlsConfig()
+		c.Certificates = append(c.Certificates, cert)
+	}
+}
+
+// NoAuth sends no credentials, for servers that only need a client
+// certificate.
+//
+type NoAuth struct{}
+
+func (NoAuth) Authorize(req *http.Request) error  { return nil }
+func (NoAuth) Challenge(resp *http.Response) bool { return false }
+
+// BasicAuth sends a login and password with every request.
+//
+type BasicAuth struct {
+	Login    string
+	Password string
+}
+
+func (a *BasicAuth) Authorize(req *http.Request) error {
+	req.SetBasicAuth(a.Login, a.Password)
+	return nil
+}
+
+func (a *BasicAuth) Challenge(resp *http.Response) bool { return false }
+
+// BearerAuth sends a token, such as a Nextcloud app password or an OAuth
+// access token, with every request.
+//
+type BearerAuth struct {
+	Token string
+}
+
+func (a *BearerAuth) Authorize(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+	return nil
+}
+
+func (a *BearerAuth) Challenge(resp *http.Response) bool { return false }
+
+// DigestAuth uses HTTP Digest authentication (RFC 7616) with the MD5 or
+// SHA-256 algorithm and "auth" quality of protection. The first request
+// is sent without credentials to get a challenge from the server, which
+// is then reused for later requests until the server says it is stale.
+//
+type DigestAuth struct {
+	Login    string
+	Password string
+
+	mu        sync.Mutex
+	challenge map[string]string // parameters from WWW-Authenticate
+	nc        int               // requests made with the current nonce
+}
+
+func (a *DigestAuth) Authorize(req *http.Request) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	c := a.challenge
+	if c == nil {
+		return nil // wait for a challenge
+	}
+
+	var h func() hash.Hash
+	switch strings.ToUpper(c["algorithm"]) {
+	case "", "MD5":
+		h = md5.New
+	case "SHA-256":
+		h = sha256.New
+	default:
+		return fmt.Errorf("digest: unsupported algorithm %q", c["algorithm"])
+	}
+	if c["qop"] != "" && !hasToken(c["qop"], "auth") {
+		return fmt.Errorf("digest: unsupported qop %q", c["qop"])
+	}
+	digest := func(parts ...string) string {
+		d := h()
+		d.Write([]byte(strings.Join(parts, ":")))
+		return fmt.Sprintf("%x", d.Sum(nil))
+	}
+
+	uri := req.URL.RequestURI()
+	ha1 := digest(a.Login, c["realm"], a.Password)
+	ha2 := digest(req.Method, uri)
+
+	fields := []string{
+		fmt.Sprintf("username=%q", a.Login),
+		fmt.Sprintf("realm=%q", c["realm"]),
+		fmt.Sprintf("nonce=%q", c["nonce"]),
+		fmt.Sprintf("uri=%q", uri),
+	}
+	if c["algorithm"] != "" {
+		fields = append(fields, "algorithm="+c["algorithm"])
+	}
+	if c["qop"] == "" {
+		fields = append(fields, fmt.Sprintf("response=%q", digest(ha1, c["nonce"], ha2)))
+	} else {
+		a.nc++
+		nc := fmt.Sprintf("%08x", a.nc)
+		cnonce, err := cnonce()
+		if err != nil {
+			return err
+		}
+		fields = append(fields,
+			"qop=auth",
+			"nc="+nc,
+			fmt.Sprintf("cnonce=%q", cnonce),
+			fmt.Sprintf("response=%q", digest(ha1, c["nonce"], nc, cnonce, "auth", ha2)),
+		)
+	}
+	if c["opaque"] != "" {
+		fields = append(fields, fmt.Sprintf("opaque=%q", c["opaque"]))
+	}
+	req.Header.Set("Authorization", "Digest "+strings.Join(fields, ", "))
+	return nil
+}
+
+// Challenge keeps the server's challenge. A request that was refused
+// with credentials is only sent again if the server says the nonce was
+// stale, so a wrong password doesn't cause a loop.
+//
+func (a *DigestAuth) Challenge(resp *http.Response) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, value := range resp.Header["Www-Authenticate"] {
+		if !strings.HasPrefix(strings.ToLower(value), "digest ") {
+			continue
+		}
+		c := parseChallenge(value[len("digest "):])
+		sent := resp.Request != nil && resp.Request.Header.Get("Authorization") != ""
+		if sent && !strings.EqualFold(c["stale"], "true") {
+			return false
+		}
+		a.challenge = c
+		a.nc = 0
+		return true
+	}
+	return false
+}
+
+// parseChallenge parses the comma separated name=value parameters of a
+// WWW-Authenticate header. Values may be quoted.
+//
+func parseChallenge(s string) map[string]string {
+	params := make(map[string]string)
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimLeft(s, ", \t") {
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		name := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimSpace(s[eq+1:])
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i < len(s) {
+				i++ // closing quote
+			}
+			value, s = b.String(), s[i:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = strings.TrimSpace(s[:end]), s[end:]
+		}
+		params[name] = value
+	}
+	return params
+}
+
+// hasToken reports whether the comma separated list s contains token.
+//
+func hasToken(s, token string) bool {
+	for _, t := range strings.Split(s, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+func cnonce() (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.New("digest: can't make cnonce: " + err.Error())
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,103 @@
+package webdav_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/wavemechanics/qdeliver/internal/webdavd"
+	"github.com/wavemechanics/qdeliver/store/webdav"
+)
+
+func TestAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestAuth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tests = []struct {
+		mode string
+		good func(server *webdavd.Server) []webdav.Option
+		bad  func(server *webdavd.Server) []webdav.Option
+	}{
+		{
+			mode: "basic",
+			good: func(server *webdavd.Server) []webdav.Option { return nil },
+			bad: func(server *webdavd.Server) []webdav.Option {
+				return []webdav.Option{webdav.WithAuth(&webdav.BasicAuth{Login: server.User, Password: "wrong"})}
+			},
+		},
+		{
+			mode: "bearer",
+			good: func(server *webdavd.Server) []webdav.Option {
+				return []webdav.Option{webdav.WithAuth(&webdav.BearerAuth{Token: server.Pass})}
+			},
+			bad: func(server *webdavd.Server) []webdav.Option {
+				return []webdav.Option{webdav.WithAuth(&webdav.BearerAuth{Token: "wrong"})}
+			},
+		},
+		{
+			mode: "digest",
+			good: func(server *webdavd.Server) []webdav.Option {
+				return []webdav.Option{webdav.WithAuth(&webdav.DigestAuth{Login: server.User, Password: server.Pass})}
+			},
+			bad: func(server *webdavd.Server) []webdav.Option {
+				return []webdav.Option{webdav.WithAuth(&webdav.DigestAuth{Login: server.User, Password: "wrong"})}
+			},
+		},
+		{
+			mode: "cert",
+			good: func(server *webdavd.Server) []webdav.Option {
+				return []webdav.Option{
+					webdav.WithAuth(webdav.NoAuth{}),
+					webdav.WithClientCert(server.ClientCert),
+					webdav.WithTLSConfig(&tls.Config{RootCAs: server.RootCAs}),
+				}
+			},
+			bad: func(server *webdavd.Server) []webdav.Option {
+				return []webdav.Option{
+					webdav.WithAuth(webdav.NoAuth{}),
+					webdav.WithTLSConfig(&tls.Config{RootCAs: server.RootCAs}),
+				}
+			},
+		},
+	}
+
+	ctx := context.TODO()
+	for _, test := range tests {
+		server := webdavd.Server{
+			Dir:  dir,
+			User: "hello",
+			Pass: "letmein",
+			Auth: test.mode,
+		}
+		shutdown := server.Start()
+
+		s, err := webdav.New(server.Addr, server.User, server.Pass, test.good(&server)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// several requests, so digest reuses its nonce
+		for _, value := range []string{"one", "two", "three"} {
+			if err = s.Set(ctx, test.mode, value); err != nil {
+				t.Errorf("%s: Set: %v", test.mode, err)
+			}
+			if got, err := s.Get(ctx, test.mode); err != nil || got != value {
+				t.Errorf("%s: Get: %q, %v, want %q", test.mode, got, err, value)
+			}
+		}
+
+		s, err = webdav.New(server.Addr, server.User, server.Pass, test.bad(&server)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = s.Get(ctx, test.mode); err == nil {
+			t.Errorf("%s: Get with bad credentials succeeded", test.mode)
+		}
+
+		shutdown()
+	}
+}
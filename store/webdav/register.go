@@ -0,0 +1,120 @@
+package webdav
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/wavemechanics/qdeliver/store"
+)
+
+func init() {
+	store.Register("http", open)
+	store.Register("https", open)
+}
+
+// open returns the webdav storage for an account, with its credentials,
+// layout, and retry and TLS settings.
+//
+func open(u *url.URL, o store.Options) (store.Storage, error) {
+	options := []Option{WithLayout(o.Layout)}
+	if r := o.Retry; r != nil {
+		options = append(options, WithRetry(Retry{
+			Attempts:   r.Attempts,
+			Backoff:    r.Backoff,
+			MaxBackoff: r.MaxBackoff,
+		}))
+	}
+	if a := o.Auth; a != nil {
+		auth, err := authOptions(a, o.Login, o.Password)
+		if err != nil {
+			return nil, fmt.Errorf("%s@%s: auth: %w", o.Owner, o.Domain, err)
+		}
+		options = append(options, auth...)
+	}
+	if t := o.TLS; t != nil {
+		tlsOpts, err := tlsOptions(t)
+		if err != nil {
+			return nil, fmt.Errorf("%s@%s: tls: %w", o.Owner, o.Domain, err)
+		}
+		options = append(options, tlsOpts...)
+	}
+	return New(u.String(), o.Login, o.Password, options...)
+}
+
+// authOptions returns the options for the authentication settings a.
+//
+func authOptions(a *store.Auth, login, password string) ([]Option, error) {
+	var options []Option
+
+	switch a.Mode {
+	case "", "basic":
+	case "digest":
+		options = append(options, WithAuth(&DigestAuth{Login: login, Password: password}))
+	case "bearer":
+		options = append(options, WithAuth(&BearerAuth{Token: password}))
+	case "cert":
+		if a.Cert == "" {
+			return nil, fmt.Errorf("mode cert needs a cert file")
+		}
+		options = append(options, WithAuth(NoAuth{}))
+	default:
+		return nil, fmt.Errorf("unknown mode %q", a.Mode)
+	}
+
+	if a.Cert != "" || a.Key != "" {
+		cert, err := tls.LoadX509KeyPair(a.Cert, a.Key)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, WithClientCert(cert))
+	}
+	return options, nil
+}
+
+// tlsVersions are the values allowed for min_version.
+//
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsOptions returns the options for the TLS settings t.
+//
+func tlsOptions(t *store.TLS) ([]Option, error) {
+	var options []Option
+
+	if t.CA != "" {
+		buf, err := ioutil.ReadFile(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("%s: no certificates found", t.CA)
+		}
+		options = append(options, WithRootCAs(pool))
+	}
+	if t.Pin != "" {
+		pin, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(t.Pin, "sha256/"))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("pin %q is not a base64 SHA-256 hash", t.Pin)
+		}
+		options = append(options, WithPin(pin))
+	}
+	if t.MinVersion != "" {
+		version, ok := tlsVersions[t.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown min_version %q", t.MinVersion)
+		}
+		options = append(options, WithMinVersion(version))
+	}
+	return options, nil
+}
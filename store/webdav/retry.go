@@ -0,0 +1,209 @@
+package webdav
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/wavemechanics/qdeliver/store"
+)
+
+// A Retry says how requests that fail with a temporary error are retried.
+// The delay before each retry starts at Backoff and doubles each time, up to
+// MaxBackoff if that is set. A random jitter of up to half the delay is
+// taken off so clients don't retry in step. If the server sends Retry-After
+// with a 429 or 503 response, that delay is used instead.
+//
+type Retry struct {
+	Attempts   int           // total number of tries; less than 2 means no retries
+	Backoff    time.Duration // delay before the first retry
+	MaxBackoff time.Duration // longest delay between tries; 0 means no limit
+}
+
+// An Option changes the way a Storage works.
+//
+type Option func(*Storage)
+
+// WithRetry sets the retry policy for requests that can safely be sent
+// again; see idempotent. By default requests are not retried.
+//
+func WithRetry(r Retry) Option {
+	return func(s *Storage) {
+		s.retry = r
+	}
+}
+
+// temporary reports whether a response status means the request might
+// work if it is tried again later.
+//
+func temporary(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+		http.StatusInsufficientStorage:
+		return true
+	}
+	return false
+}
+
+// statusError returns an error for a response with a failure status. It
+// is marked store.Unavailable if the status is temporary.
+//
+func statusError(resp *http.Response) error {
+	err := errors.New(resp.Status)
+	if temporary(resp.StatusCode) {
+		return store.Unavailable(err)
+	}
+	return err
+}
+
+// networkError marks an error from sending a request as store.Unavailable,
+// unless the server was reached but its certificate wasn't accepted.
+//
+func networkError(err error) error {
+	var unknown x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	if errors.Is(err, ErrPinMismatch) || errors.As(err, &unknown) || errors.As(err, &hostname) || errors.As(err, &invalid) {
+		return err
+	}
+	return store.Unavailable(err)
+}
+
+// do sends the request returned by newRequest, retrying network errors and
+// temporary failures according to s.retry if the request is idempotent.
+// newRequest is called for every try so that request bodies can be sent
+// again.
+// If the last try got a response, it is returned even if its status shows
+// a failure, so the caller can interpret it.
+//
+func (s *Storage) do(ctx context.Context, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		req, resp, err := s.send(ctx, newRequest)
+		if err == nil && !temporary(resp.StatusCode) {
+			return resp, nil
+		}
+		if attempt >= s.retry.Attempts || ctx.Err() != nil || errors.Is(err, ErrPinMismatch) || req == nil || !idempotent(req) {
+			return resp, err
+		}
+
+		delay := s.retry.delay(attempt, resp)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return resp, err // would time out before trying again
+		}
+		if resp != nil {
+			err = statusError(resp)
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+	}
+}
+
+// idempotent reports whether req can be sent again after a try that may
+// have reached the server. A conditional PUT or a DELETE can't: if the
+// first try worked, the second fails its precondition or finds nothing,
+// and the caller would report a failure for a change that was made. MKCOL
+// can, since mkdirs takes 405 to mean the directory exists.
+//
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, "PROPFIND", "MKCOL":
+		return true
+	case http.MethodPut:
+		for _, name := range []string{"If-Match", "If-None-Match", "If-Unmodified-Since"} {
+			if req.Header.Get(name) != "" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// send sends one request with credentials. If the server challenges them
+// and the Authenticator can answer, the request is sent once more.
+// The request last sent is returned, if any was.
+//
+func (s *Storage) send(ctx context.Context, newRequest func() (*http.Request, error)) (*http.Request, *http.Response, error) {
+	for challenged := false; ; challenged = true {
+		req, err := newRequest()
+		if err != nil {
+			return nil, nil, err
+		}
+		req = req.WithContext(ctx)
+		if err = s.auth.Authorize(req); err != nil {
+			return nil, nil, err
+		}
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return req, nil, networkError(err)
+		}
+		if resp.StatusCode != http.StatusUnauthorized || challenged || !s.auth.Challenge(resp) {
+			return req, resp, nil
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// delay returns how long to wait before the retry following attempt,
+// which got resp if it got a response at all.
+//
+func (r Retry) delay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if d, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+			return d
+		}
+	}
+
+	d := r.Backoff
+	for i := 1; i < attempt && (r.MaxBackoff == 0 || d < r.MaxBackoff); i++ {
+		d *= 2
+	}
+	if r.MaxBackoff > 0 && d > r.MaxBackoff {
+		d = r.MaxBackoff
+	}
+	if d > 1 {
+		d -= time.Duration(rand.Int63n(int64(d / 2)))
+	}
+	return d
+}
+
+// retryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date.
+//
+func retryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
@@ -0,0 +1,166 @@
+package webdav_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wavemechanics/qdeliver/store"
+	"github.com/wavemechanics/qdeliver/store/webdav"
+)
+
+// flaky returns a handler that fails with each of statuses in turn, then
+// succeeds. It counts the requests it gets in *n.
+func flaky(n *int, retryAfter string, statuses ...int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*n++
+		if *n <= len(statuses) {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			http.Error(w, "failing", statuses[*n-1])
+			return
+		}
+		if r.Method == http.MethodPut {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.Write([]byte("value"))
+	}
+}
+
+func TestRetry(t *testing.T) {
+	retry := webdav.Retry{
+		Attempts:   3,
+		Backoff:    time.Millisecond,
+		MaxBackoff: 2 * time.Millisecond,
+	}
+
+	var tests = []struct {
+		name       string
+		retry      webdav.Retry
+		retryAfter string
+		statuses   []int
+		ok         bool
+		requests   int
+	}{
+		{"no retry policy", webdav.Retry{}, "", []int{503}, false, 1},
+		{"succeeds on retry", retry, "", []int{503, 500}, true, 3},
+		{"runs out of attempts", retry, "", []int{502, 504, 503}, false, 3},
+		{"507 is temporary", retry, "", []int{507}, true, 2},
+		{"404 is permanent", retry, "", []int{404}, false, 1},
+		{"401 is permanent", retry, "", []int{401}, false, 1},
+		{"Retry-After seconds", retry, "0", []int{429}, true, 2},
+		{"Retry-After too long", retry, "3600", []int{503}, false, 1},
+	}
+
+	for _, test := range tests {
+		for _, method := range []string{http.MethodGet, http.MethodPut} {
+			var n int
+			ts := httptest.NewServer(flaky(&n, test.retryAfter, test.statuses...))
+
+			s, err := webdav.New(ts.URL, "", "", webdav.WithRetry(test.retry))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if method == http.MethodGet {
+				_, err = s.Get(ctx, "key")
+			} else {
+				err = s.Set(ctx, "key", "value")
+			}
+			cancel()
+			ts.Close()
+
+			if test.ok && err != nil {
+				t.Errorf("%s: %s: %v", test.name, method, err)
+			}
+			if !test.ok && err == nil {
+				t.Errorf("%s: %s: expected error", test.name, method)
+			}
+			if n != test.requests {
+				t.Errorf("%s: %s: %d requests, want %d", test.name, method, n, test.requests)
+			}
+		}
+	}
+}
+
+// TestRetryIdempotent tests that requests which would fail if an earlier
+// try had worked are not retried
+func TestRetryIdempotent(t *testing.T) {
+	var tests = []struct {
+		name string
+		op   func(ctx context.Context, s *webdav.Storage) error
+	}{
+		{"Create", func(ctx context.Context, s *webdav.Storage) error { return s.Create(ctx, "key", "value") }},
+		{"SetIf", func(ctx context.Context, s *webdav.Storage) error {
+			return s.SetIf(ctx, "key", "value", store.Revision{ETag: `"1"`})
+		}},
+		{"Delete", func(ctx context.Context, s *webdav.Storage) error { return s.Delete(ctx, "key") }},
+	}
+
+	for _, test := range tests {
+		var n int
+		ts := httptest.NewServer(flaky(&n, "", 503))
+		s, err := webdav.New(ts.URL, "", "", webdav.WithRetry(webdav.Retry{Attempts: 3}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = test.op(context.TODO(), s)
+		ts.Close()
+		if !errors.Is(err, store.ErrUnavailable) || n != 1 {
+			t.Errorf("%s: %v after %d requests, want %v after 1", test.name, err, n, store.ErrUnavailable)
+		}
+	}
+}
+
+func TestRetryStatus(t *testing.T) {
+	var n int
+	ts := httptest.NewServer(flaky(&n, "", 503, 503, 503))
+	defer ts.Close()
+
+	s, err := webdav.New(ts.URL, "", "", webdav.WithRetry(webdav.Retry{Attempts: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Get(context.TODO(), "key")
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("Get: %v, want 503 error", err)
+	}
+}
+
+// TestUnavailable tests which failures are marked store.ErrUnavailable
+func TestUnavailable(t *testing.T) {
+	var tests = []struct {
+		name        string
+		status      int // 0 for no server
+		unavailable bool
+	}{
+		{"no server", 0, true},
+		{"503", http.StatusServiceUnavailable, true},
+		{"504", http.StatusGatewayTimeout, true},
+		{"401", http.StatusUnauthorized, false},
+		{"403", http.StatusForbidden, false},
+	}
+	for _, test := range tests {
+		var n int
+		ts := httptest.NewServer(flaky(&n, "", test.status))
+		if test.status == 0 {
+			ts.Close()
+		}
+		s, err := webdav.New(ts.URL, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.Get(context.TODO(), "key")
+		ts.Close()
+		if err == nil || errors.Is(err, store.ErrUnavailable) != test.unavailable {
+			t.Errorf("%s: %v, want unavailable %v", test.name, err, test.unavailable)
+		}
+	}
+}
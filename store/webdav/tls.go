@@ -0,0 +1,75 @@
+package webdav
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/wavemechanics/etype"
+)
+
+const ErrPinMismatch = etype.Sentinel("server certificate does not match pin")
+
+// WithTLSConfig sets the TLS settings used for https URLs. It replaces the
+// settings made by earlier TLS options, except for client certificates.
+//
+func WithTLSConfig(config *tls.Config) Option {
+	return func(s *Storage) {
+		c := config.Clone()
+		if s.tls != nil {
+			c.Certificates = append(c.Certificates, s.tls.Certificates...)
+		}
+		s.tls = c
+	}
+}
+
+// WithRootCAs trusts only the certificate authorities in pool, instead of
+// the system's.
+//
+func WithRootCAs(pool *x509.CertPool) Option {
+	return func(s *Storage) {
+		s.tlsConfig().RootCAs = pool
+	}
+}
+
+// WithMinVersion refuses TLS versions older than version, such as
+// tls.VersionTLS12.
+//
+func WithMinVersion(version uint16) Option {
+	return func(s *Storage) {
+		s.tlsConfig().MinVersion = version
+	}
+}
+
+// WithPin only accepts servers whose verified certificate chain includes a
+// certificate with the given SHA-256 hash of its SubjectPublicKeyInfo.
+// A server that doesn't match fails with an error wrapping ErrPinMismatch,
+// which is not retried.
+//
+func WithPin(pin []byte) Option {
+	return func(s *Storage) {
+		s.tlsConfig().VerifyPeerCertificate = func(raw [][]byte, chains [][]*x509.Certificate) error {
+			for _, chain := range chains {
+				for _, cert := range chain {
+					sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+					if bytes.Equal(sum[:], pin) {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("%w %s", ErrPinMismatch, base64.StdEncoding.EncodeToString(pin))
+		}
+	}
+}
+
+// tlsConfig returns s's TLS settings, creating them if there are none yet.
+//
+func (s *Storage) tlsConfig() *tls.Config {
+	if s.tls == nil {
+		s.tls = &tls.Config{}
+	}
+	return s.tls
+}
@@ -0,0 +1,78 @@
+package webdav_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/wavemechanics/qdeliver/internal/webdavd"
+	"github.com/wavemechanics/qdeliver/store"
+	"github.com/wavemechanics/qdeliver/store/webdav"
+)
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestTLS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := webdavd.Server{
+		Dir:  dir,
+		User: "hello",
+		Pass: "letmein",
+		TLS:  true,
+	}
+	shutdown := server.Start()
+	defer shutdown()
+
+	pin := sha256.Sum256(server.Certificate.RawSubjectPublicKeyInfo)
+	wrong := sha256.Sum256([]byte("some other key"))
+	retry := webdav.WithRetry(webdav.Retry{Attempts: 3, Backoff: time.Second})
+
+	var tests = []struct {
+		name    string
+		options []webdav.Option
+		err     error // nil for any error
+		ok      bool
+	}{
+		{"system roots", nil, nil, false},
+		{"root CAs", []webdav.Option{webdav.WithRootCAs(server.RootCAs)}, nil, true},
+		{"TLS 1.3", []webdav.Option{webdav.WithRootCAs(server.RootCAs), webdav.WithMinVersion(tls.VersionTLS13)}, nil, true},
+		{"pin", []webdav.Option{webdav.WithRootCAs(server.RootCAs), webdav.WithPin(pin[:])}, nil, true},
+		{"wrong pin", []webdav.Option{webdav.WithRootCAs(server.RootCAs), webdav.WithPin(wrong[:]), retry}, webdav.ErrPinMismatch, false},
+	}
+
+	ctx := context.TODO()
+	for _, test := range tests {
+		s, err := webdav.New(server.Addr, server.User, server.Pass, test.options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		err = s.Set(ctx, "key", "value")
+		if test.ok {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: succeeded, want error", test.name)
+		}
+		if test.err != nil && !errors.Is(err, test.err) {
+			t.Errorf("%s: %v, want %v", test.name, err, test.err)
+		}
+		if errors.Is(err, store.ErrUnavailable) {
+			t.Errorf("%s: %v looks like an unreachable server", test.name, err)
+		}
+		if time.Since(start) > time.Second {
+			t.Errorf("%s: retried", test.name)
+		}
+	}
+}
@@ -2,85 +2,425 @@ package webdav
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/xml"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/wavemechanics/qdeliver/store"
+	"github.com/wavemechanics/qdeliver/store/layout"
 )
 
 type Storage struct {
-	url      string
-	login    string
-	password string
-	client   *http.Client
+	url    string
+	auth   Authenticator
+	tls    *tls.Config // nil for the default TLS settings
+	client *http.Client
+	retry  Retry
+	layout layout.Layout
 }
 
-func New(url, login, password string) (*Storage, error) {
-	return &Storage{
-		url:      url,
-		login:    login,
-		password: password,
-		client:   &http.Client{},
-	}, nil
+// New returns a Storage for the webdav directory at url. Requests use
+// HTTP Basic authentication with login and password unless an option
+// says otherwise.
+//
+func New(url, login, password string, options ...Option) (*Storage, error) {
+	s := &Storage{
+		url:    url,
+		auth:   &BasicAuth{Login: login, Password: password},
+		client: &http.Client{},
+		layout: layout.Default,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	if s.tls != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = s.tls
+		s.client.Transport = transport
+	}
+	return s, nil
 }
 
-func (s *Storage) Get(ctx context.Context, key string) (string, error) {
+// WithLayout sets how keys are mapped to file names. By default they are
+// layout.Default.
+//
+func WithLayout(l layout.Layout) Option {
+	return func(s *Storage) {
+		s.layout = l
+	}
+}
+
+// path returns the URL of the file holding key.
+// Keys that would name another directory are rejected.
+//
+func (s *Storage) path(key string) (string, error) {
 	if key == "" {
 		return "", store.ErrEmptyKey
 	}
+	if !s.layout.Valid(key) {
+		return "", store.ErrBadKey
+	}
+	return s.url + "/" + s.layout.Path(key), nil
+}
 
-	path := s.url + "/" + url.PathEscape(key) + ".txt"
-	req, err := http.NewRequest(http.MethodGet, path, nil)
+func (s *Storage) Get(ctx context.Context, key string) (string, error) {
+	value, _, err := s.GetIfChanged(ctx, key, store.Revision{})
+	return value, err
+}
+
+// GetIfChanged makes a conditional GET request using the ETag and
+// Last-Modified values in rev.
+//
+func (s *Storage) GetIfChanged(ctx context.Context, key string, rev store.Revision) (string, store.Revision, error) {
+	path, err := s.path(key)
 	if err != nil {
-		return "", err
+		return "", store.Revision{}, err
 	}
-	req = req.WithContext(ctx)
-	req.SetBasicAuth(s.login, s.password)
 
-	resp, err := s.client.Do(req)
+	resp, err := s.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if rev.ETag != "" {
+			req.Header.Set("If-None-Match", rev.ETag)
+		}
+		if rev.LastModified != "" {
+			req.Header.Set("If-Modified-Since", rev.LastModified)
+		}
+		return req, nil
+	})
 	if err != nil {
-		return "", err
+		return "", store.Revision{}, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode == http.StatusNotFound {
-		return "", os.ErrNotExist
+		return "", store.Revision{}, os.ErrNotExist
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		return "", rev, store.ErrNotModified
 	}
 	if resp.StatusCode != http.StatusOK {
-		return "", errors.New(resp.Status)
+		return "", store.Revision{}, statusError(resp)
 	}
 
 	content, err := ioutil.ReadAll(resp.Body)
-	return string(content), nil
+	if err != nil {
+		return "", store.Revision{}, err
+	}
+	rev = store.Revision{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	return string(content), rev, nil
 }
 
 func (s *Storage) Set(ctx context.Context, key, value string) error {
-	if key == "" {
-		return store.ErrEmptyKey
-	}
+	return s.put(ctx, key, value, nil, nil)
+}
 
-	path := s.url + "/" + url.PathEscape(key) + ".txt"
+// Create stores value only if key doesn't exist, using an
+// "If-None-Match: *" request. The server must support it for this to be
+// atomic.
+//
+func (s *Storage) Create(ctx context.Context, key, value string) error {
+	return s.put(ctx, key, value, http.Header{"If-None-Match": {"*"}}, os.ErrExist)
+}
+
+// GetVersion returns the value of key and its revision.
+//
+func (s *Storage) GetVersion(ctx context.Context, key string) (string, store.Revision, error) {
+	return s.GetIfChanged(ctx, key, store.Revision{})
+}
+
+// SetIf stores value using an If-Match request, or If-Unmodified-Since if
+// the server gave no entity tag.
+//
+func (s *Storage) SetIf(ctx context.Context, key, value string, rev store.Revision) error {
+	header := make(http.Header)
+	switch {
+	case rev.ETag != "":
+		header.Set("If-Match", rev.ETag)
+	case rev.LastModified != "":
+		header.Set("If-Unmodified-Since", rev.LastModified)
+	default:
+		return fmt.Errorf("%s: no revision: %w", key, store.ErrConflict)
+	}
+	return s.put(ctx, key, value, header, store.ErrConflict)
+}
 
-	req, err := http.NewRequest(http.MethodPut, path, strings.NewReader(value))
+// put makes a PUT request with any extra header given.
+// If a precondition in header fails, the error wraps failed.
+//
+func (s *Storage) put(ctx context.Context, key, value string, header http.Header, failed error) error {
+	path, err := s.path(key)
 	if err != nil {
 		return err
 	}
-	req = req.WithContext(ctx)
-	req.SetBasicAuth(s.login, s.password)
-	req.Header.Set("Content-Type", "text/plain")
 
-	resp, err := s.client.Do(req)
+	for try := 1; ; try++ {
+		resp, err := s.do(ctx, func() (*http.Request, error) {
+			req, err := http.NewRequest(http.MethodPut, path, strings.NewReader(value))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "text/plain")
+			for name, values := range header {
+				req.Header[name] = values
+			}
+			return req, nil
+		})
+		if err != nil {
+			return err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+			return nil
+		case http.StatusPreconditionFailed:
+			if failed != nil {
+				return fmt.Errorf("%s: %w", key, failed)
+			}
+		case http.StatusConflict, http.StatusNotFound:
+			// the directories holding the file may not exist yet; RFC 4918
+			// says 409, but some servers say 404
+			if try == 1 && s.layout.Depth() > 0 {
+				if err = s.mkdirs(ctx, key); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		return statusError(resp)
+	}
+}
+
+// mkdirs creates the directories holding key, using MKCOL requests.
+// Directories that already exist are left alone.
+//
+func (s *Storage) mkdirs(ctx context.Context, key string) error {
+	dir := s.url
+	for _, d := range s.layout.Dirs(key) {
+		dir += "/" + url.PathEscape(d)
+		resp, err := s.do(ctx, func() (*http.Request, error) {
+			return http.NewRequest("MKCOL", dir+"/", nil)
+		})
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+			return fmt.Errorf("MKCOL %s: %w", dir, statusError(resp))
+		}
+	}
+	return nil
+}
+
+// propfindBody asks for the properties List and Stat use.
+//
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop>
+<resourcetype/><getcontentlength/><getlastmodified/><getetag/>
+</prop></propfind>`
+
+// multistatus is the part of a PROPFIND response that List and Stat use.
+//
+type multistatus struct {
+	Responses []response `xml:"response"`
+}
+
+type response struct {
+	Href     string `xml:"href"`
+	Propstat []struct {
+		Prop struct {
+			ResourceType struct {
+				Collection *struct{} `xml:"collection"`
+			} `xml:"resourcetype"`
+			ContentLength string `xml:"getcontentlength"`
+			LastModified  string `xml:"getlastmodified"`
+			ETag          string `xml:"getetag"`
+		} `xml:"prop"`
+		Status string `xml:"status"`
+	} `xml:"propstat"`
+}
+
+// collection reports whether r describes a directory.
+//
+func (r *response) collection() bool {
+	for _, ps := range r.Propstat {
+		if strings.Contains(ps.Status, " 200 ") && ps.Prop.ResourceType.Collection != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// propfind fetches the properties of the resource at path, and of its
+// members if depth is "1".
+//
+func (s *Storage) propfind(ctx context.Context, path, depth string) (*multistatus, error) {
+	resp, err := s.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest("PROPFIND", path, strings.NewReader(propfindBody))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/xml")
+		req.Header.Set("Depth", depth)
+		return req, nil
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, statusError(resp)
+	}
 
-	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
-		return errors.New(resp.Status)
+	var ms multistatus
+	if err = xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, err
 	}
+	return &ms, nil
+}
 
-	return nil
+// List returns the keys of all the files in the webdav directory that
+// belong to its layout. Sharded layouts are walked one directory at a
+// time, since many servers refuse "Depth: infinity".
+//
+func (s *Storage) List(ctx context.Context) ([]string, error) {
+	base, err := url.Parse(s.url)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.TrimSuffix(path.Clean("/"+base.Path), "/") + "/"
+
+	var keys []string
+	dirs := []string{""} // escaped paths relative to s.url, ending in "/"
+	for depth := 0; depth <= s.layout.Depth(); depth++ {
+		var next []string
+		for _, dir := range dirs {
+			ms, err := s.propfind(ctx, s.url+"/"+dir, "1")
+			if errors.Is(err, os.ErrNotExist) && depth > 0 {
+				continue // removed since its parent was listed
+			}
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range ms.Responses {
+				u, err := url.Parse(r.Href)
+				if err != nil {
+					return nil, err
+				}
+				if !strings.HasPrefix(u.Path, prefix) {
+					continue
+				}
+				rel := strings.TrimPrefix(u.Path, prefix)
+				if escape(rel) == dir {
+					continue // the directory itself
+				}
+				if strings.HasSuffix(rel, "/") || r.collection() {
+					if depth < s.layout.Depth() {
+						next = append(next, escape(strings.TrimSuffix(rel, "/"))+"/")
+					}
+					continue
+				}
+				if key, ok := s.layout.Key(rel); ok && depth == s.layout.Depth() {
+					keys = append(keys, key)
+				}
+			}
+		}
+		dirs = next
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// escape path escapes each element of the slash separated path p.
+//
+func escape(p string) string {
+	parts := strings.Split(p, "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	return strings.Join(parts, "/")
+}
+
+// Stat describes the file holding key, using a PROPFIND request.
+//
+func (s *Storage) Stat(ctx context.Context, key string) (store.Info, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return store.Info{}, err
+	}
+
+	ms, err := s.propfind(ctx, path, "0")
+	if err != nil {
+		return store.Info{}, err
+	}
+	if len(ms.Responses) != 1 {
+		return store.Info{}, fmt.Errorf("PROPFIND: %d responses, want 1", len(ms.Responses))
+	}
+
+	var info store.Info
+	for _, ps := range ms.Responses[0].Propstat {
+		if !strings.Contains(ps.Status, " 200 ") {
+			continue // properties the server doesn't have
+		}
+		if ps.Prop.ResourceType.Collection != nil {
+			return store.Info{}, os.ErrNotExist
+		}
+		if ps.Prop.ContentLength != "" {
+			info.Size, err = strconv.ParseInt(ps.Prop.ContentLength, 10, 64)
+			if err != nil {
+				return store.Info{}, fmt.Errorf("PROPFIND: bad getcontentlength: %w", err)
+			}
+		}
+		if ps.Prop.LastModified != "" {
+			info.ModTime, err = http.ParseTime(ps.Prop.LastModified)
+			if err != nil {
+				return store.Info{}, fmt.Errorf("PROPFIND: bad getlastmodified: %w", err)
+			}
+		}
+		if ps.Prop.ETag != "" {
+			info.ETag = ps.Prop.ETag
+		}
+	}
+	return info, nil
+}
+
+func (s *Storage) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodDelete, path, nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusAccepted, http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return os.ErrNotExist
+	}
+	return statusError(resp)
 }
@@ -8,11 +8,17 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/wavemechanics/qdeliver/internal/webdavd"
 	"github.com/wavemechanics/qdeliver/lookup"
 	"github.com/wavemechanics/qdeliver/store"
+	"github.com/wavemechanics/qdeliver/store/layout"
 	"github.com/wavemechanics/qdeliver/store/mem"
 	"github.com/wavemechanics/qdeliver/store/webdav"
 )
@@ -162,3 +168,331 @@ func TestFound(t *testing.T) {
 		t.Fatalf("Looking contents: %q, want %q", contents, "some value")
 	}
 }
+
+func TestList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestList")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"b.txt", "a b.txt", "default.txt", "notes.doc"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte("drop\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.Mkdir(filepath.Join(dir, "sub.txt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	server := webdavd.Server{
+		Dir:  dir,
+		User: "hello",
+		Pass: "letmein",
+	}
+	shutdown := server.Start()
+	defer shutdown()
+
+	s, err := webdav.New(server.Addr, server.User, server.Pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := s.List(context.TODO())
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	want := []string{"a b", "b", "default"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("List: %q, want %q", keys, want)
+	}
+
+	s, err = webdav.New(server.Addr, server.User, "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.List(context.TODO()); err == nil {
+		t.Fatal("List with wrong password: expected error")
+	}
+}
+
+func TestGetIfChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestGetIfChanged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := webdavd.Server{
+		Dir:  dir,
+		User: "hello",
+		Pass: "letmein",
+	}
+	shutdown := server.Start()
+	defer shutdown()
+
+	s, err := webdav.New(server.Addr, server.User, server.Pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.TODO()
+	if err = s.Set(ctx, "key", "one"); err != nil {
+		t.Fatal(err)
+	}
+
+	value, rev, err := s.GetIfChanged(ctx, "key", store.Revision{})
+	if err != nil || value != "one" {
+		t.Fatalf("GetIfChanged: %q, %v, want %q", value, err, "one")
+	}
+	if rev.ETag == "" {
+		t.Fatal("GetIfChanged: no ETag")
+	}
+
+	if _, _, err = s.GetIfChanged(ctx, "key", rev); err != store.ErrNotModified {
+		t.Fatalf("GetIfChanged unchanged: %v, want %v", err, store.ErrNotModified)
+	}
+
+	if err = s.Set(ctx, "key", "two, longer"); err != nil {
+		t.Fatal(err)
+	}
+	value, _, err = s.GetIfChanged(ctx, "key", rev)
+	if err != nil || value != "two, longer" {
+		t.Fatalf("GetIfChanged changed: %q, %v, want %q", value, err, "two, longer")
+	}
+}
+
+func TestStatDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestStatDelete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = os.Mkdir(filepath.Join(dir, "sub.txt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	server := webdavd.Server{
+		Dir:  dir,
+		User: "hello",
+		Pass: "letmein",
+	}
+	shutdown := server.Start()
+	defer shutdown()
+
+	s, err := webdav.New(server.Addr, server.User, server.Pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.TODO()
+	before := time.Now().Add(-time.Second)
+	if err = s.Set(ctx, "a key", "some value"); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := s.Stat(ctx, "a key")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Size != int64(len("some value")) {
+		t.Errorf("Stat: size %d, want %d", info.Size, len("some value"))
+	}
+	if info.ModTime.Before(before.Truncate(time.Second)) {
+		t.Errorf("Stat: modified %v, want after %v", info.ModTime, before)
+	}
+	_, rev, err := s.GetIfChanged(ctx, "a key", store.Revision{})
+	if err != nil || info.ETag == "" || info.ETag != rev.ETag {
+		t.Errorf("Stat: ETag %q, want %q (%v)", info.ETag, rev.ETag, err)
+	}
+
+	for _, key := range []string{"missing", "sub"} {
+		if _, err = s.Stat(ctx, key); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Stat %s: %v, want %v", key, err, os.ErrNotExist)
+		}
+	}
+
+	if err = s.Delete(ctx, "a key"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err = s.Get(ctx, "a key"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Get after Delete: %v, want %v", err, os.ErrNotExist)
+	}
+	if err = s.Delete(ctx, "a key"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Delete again: %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestCreate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := webdavd.Server{
+		Dir:  dir,
+		User: "hello",
+		Pass: "letmein",
+	}
+	shutdown := server.Start()
+	defer shutdown()
+
+	s, err := webdav.New(server.Addr, server.User, server.Pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.TODO()
+	if err = s.Create(ctx, "key", "first"); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err = s.Create(ctx, "key", "second"); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("Create again: %v, want %v", err, os.ErrExist)
+	}
+	if value, _ := s.Get(ctx, "key"); value != "first" {
+		t.Fatalf("Get: %q, want %q", value, "first")
+	}
+
+	// many deliveries to a new address at once create it exactly once
+	if err = s.Set(ctx, lookup.Default, "drop"); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, ok, err := lookup.Lookup(ctx, s, "new")
+			if err != nil {
+				t.Error(err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if ok {
+				created++
+			}
+		}()
+	}
+	wg.Wait()
+	if created != 1 {
+		t.Fatalf("created %d times, want 1", created)
+	}
+}
+
+func TestSetIf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestSetIf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := webdavd.Server{
+		Dir:  dir,
+		User: "hello",
+		Pass: "letmein",
+	}
+	shutdown := server.Start()
+	defer shutdown()
+
+	s, err := webdav.New(server.Addr, server.User, server.Pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.TODO()
+	if err = s.Set(ctx, "key", "one"); err != nil {
+		t.Fatal(err)
+	}
+	value, rev, err := s.GetVersion(ctx, "key")
+	if err != nil || value != "one" {
+		t.Fatalf("GetVersion: %q, %v, want %q", value, err, "one")
+	}
+
+	// the user edits the file through their own mount
+	if err = ioutil.WriteFile(filepath.Join(dir, "key.txt"), []byte("user's edit"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetIf(ctx, "key", "two", rev); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("SetIf after edit: %v, want %v", err, store.ErrConflict)
+	}
+
+	value, rev, err = s.GetVersion(ctx, "key")
+	if err != nil || value != "user's edit" {
+		t.Fatalf("GetVersion: %q, %v, want %q", value, err, "user's edit")
+	}
+	if err = s.SetIf(ctx, "key", "two", rev); err != nil {
+		t.Fatalf("SetIf: %v", err)
+	}
+	if value, _ = s.Get(ctx, "key"); value != "two" {
+		t.Fatalf("Get: %q, want %q", value, "two")
+	}
+
+	if err = s.SetIf(ctx, "missing", "value", rev); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("SetIf missing: %v, want %v", err, store.ErrConflict)
+	}
+}
+
+func TestLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestLayout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := webdavd.Server{
+		Dir:  dir,
+		User: "hello",
+		Pass: "letmein",
+	}
+	shutdown := server.Start()
+	defer shutdown()
+
+	s, err := webdav.New(server.Addr, server.User, server.Pass,
+		webdav.WithLayout(layout.Layout{Dir: "me", Shard: 2, Ext: ".conf"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.TODO()
+
+	for _, key := range []string{"me-amazon", "me", "a b", "default"} {
+		if err = s.Set(ctx, key, key); err != nil {
+			t.Fatalf("Set %s: %v", key, err)
+		}
+	}
+	if err = s.Create(ctx, "x", "x"); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "me", "a", "a ", "a b.conf")); err != nil {
+		t.Fatalf("sharded file: %v", err)
+	}
+	if value, err := s.Get(ctx, "a b"); err != nil || value != "a b" {
+		t.Fatalf("Get: %q, %v", value, err)
+	}
+	if info, err := s.Stat(ctx, "me-amazon"); err != nil || info.Size != int64(len("me-amazon")) {
+		t.Fatalf("Stat: %+v, %v", info, err)
+	}
+
+	// files outside the layout are not listed
+	ioutil.WriteFile(filepath.Join(dir, "me", "stray.conf"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "me", "m", "me", "mx.conf"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "me", "m", "me", "me-notes.txt"), nil, 0644)
+
+	keys, err := s.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a b", "default", "me", "me-amazon", "x"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("List: %q, want %q", keys, want)
+	}
+
+	if err = s.Delete(ctx, "me-amazon"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err = s.Set(ctx, "..x", "value"); !errors.Is(err, store.ErrBadKey) {
+		t.Fatalf("Set ..x: %v, want %v", err, store.ErrBadKey)
+	}
+}
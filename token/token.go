@@ -2,6 +2,7 @@ package token
 
 import (
 	"strings"
+	"unicode/utf8"
 
 	"github.com/wavemechanics/etype"
 )
@@ -16,7 +17,17 @@ type splitter struct {
 	src    string   // string we are splitting
 	next   int      // next char in string
 	tok    string   // token we are building up
+	start  int      // where tok starts in src, or -1
 	tokens []string // tokens accumulated so far
+	starts []int    // where each of tokens starts in src
+}
+
+// A Token is a token from a line, and the column it starts in.
+// Columns count runes, starting from 1.
+//
+type Token struct {
+	Text string
+	Col  int
 }
 
 // SplitFile splits a string into lines delimited by \r, \r\n, or \n
@@ -29,7 +40,8 @@ func SplitFile(contents string) []string {
 
 func SplitLine(line string) ([]string, error) {
 	s := &splitter{
-		src: line,
+		src:   line,
+		start: -1,
 	}
 	if err := s.split(); err != nil {
 		return nil, err
@@ -37,15 +49,42 @@ func SplitLine(line string) ([]string, error) {
 	return s.tokens, nil
 }
 
+// Scan splits a line like SplitLine, but also returns the column of each token.
+// If there is an error, col is the column of the token that caused it.
+//
+func Scan(line string) (tokens []Token, col int, err error) {
+	s := &splitter{
+		src:   line,
+		start: -1,
+	}
+	if err := s.split(); err != nil {
+		return nil, s.col(s.start), err
+	}
+	for i, tok := range s.tokens {
+		tokens = append(tokens, Token{Text: tok, Col: s.col(s.starts[i])})
+	}
+	return tokens, 0, nil
+}
+
+// col converts an offset in the source line to a column number.
+//
+func (s *splitter) col(offset int) int {
+	if offset < 0 {
+		offset = s.next
+	}
+	return utf8.RuneCountInString(s.src[:offset]) + 1
+}
+
 func (s *splitter) split() error {
 	for s.next < len(s.src) {
 		var err error
-		switch s.src[s.next] {
+		c := s.src[s.next]
+		if s.start < 0 && c != ' ' && c != '\t' && c != '#' {
+			s.start = s.next
+		}
+		switch c {
 		case ' ', '\t':
-			if s.tok != "" {
-				s.tokens = append(s.tokens, s.tok)
-				s.tok = ""
-			}
+			s.emit()
 			s.next++
 		case '#':
 			return nil
@@ -62,11 +101,19 @@ func (s *splitter) split() error {
 			return err
 		}
 	}
+	s.emit()
+	return nil
+}
+
+// emit adds the token built up so far, if any, to the list of tokens.
+//
+func (s *splitter) emit() {
 	if s.tok != "" {
 		s.tokens = append(s.tokens, s.tok)
+		s.starts = append(s.starts, s.start)
 		s.tok = ""
 	}
-	return nil
+	s.start = -1
 }
 
 func (s *splitter) chunk() {
@@ -129,6 +129,46 @@ func TestSplitLine(t *testing.T) {
 	}
 }
 
+func TestScan(t *testing.T) {
+	var tests = []struct {
+		line   string
+		err    error
+		col    int
+		tokens []token.Token
+	}{
+		{"", nil, 0, nil},
+		{"# comment", nil, 0, nil},
+		{"a", nil, 0, []token.Token{{"a", 1}}},
+		{"  a\tbc  'd e'", nil, 0, []token.Token{{"a", 3}, {"bc", 5}, {"d e", 9}}},
+		{`a\ b "c"d`, nil, 0, []token.Token{{"a b", 1}, {"cd", 6}}},
+		{"é a", nil, 0, []token.Token{{"é", 1}, {"a", 3}}},
+		{`a 'b`, token.ErrSquote, 3, nil},
+		{`a  "b\"`, token.ErrDquote, 4, nil},
+		{`a b\`, token.ErrEscape, 3, nil},
+	}
+
+	for _, test := range tests {
+		tokens, col, err := token.Scan(test.line)
+		if err != test.err {
+			t.Errorf("Scan: %q: %v, want %v", test.line, err, test.err)
+			continue
+		}
+		if col != test.col {
+			t.Errorf("Scan: %q: col %d, want %d", test.line, col, test.col)
+		}
+		if len(tokens) != len(test.tokens) {
+			t.Errorf("Scan: %q: %+v, want %+v", test.line, tokens, test.tokens)
+			continue
+		}
+		for i := range tokens {
+			if tokens[i] != test.tokens[i] {
+				t.Errorf("Scan: %q: %+v, want %+v", test.line, tokens, test.tokens)
+				break
+			}
+		}
+	}
+}
+
 func tokensMatch(a, b []string) bool {
 	if len(a) != len(b) {
 		return false
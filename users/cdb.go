@@ -0,0 +1,215 @@
+package users
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/wavemechanics/qdeliver/cdb"
+)
+
+// A user database can also be kept in a cdb file, with a record for each
+// account, keyed by owner@domain, holding the account as JSON. One more
+// record, versionKey, holds the version. Unlike a JSON database, it
+// doesn't need to be read in full to look up one account.
+
+// versionKey is the key of the version record in a cdb database. It can't
+// be the key of an account, which always has an "@".
+//
+const versionKey = "version"
+
+// cdbKey returns the key of the account for owner@domain in a cdb database.
+//
+func cdbKey(owner, domain string) []byte {
+	return []byte(owner + "@" + domain)
+}
+
+// A DB finds the account for an owner and domain.
+// Lookup returns an error wrapping os.ErrNotExist if there isn't one.
+//
+type DB interface {
+	Lookup(owner, domain string) (*Account, error)
+	Close() error
+}
+
+// Open opens the user database at path for looking up accounts. A cdb
+// database is read as accounts are looked up, and a JSON database is
+// loaded in full, as with Load.
+//
+// A database anyone can read must not hold passwords; see CheckSecrets.
+// A JSON database is checked when it is opened, and a cdb database as
+// each account is looked up.
+//
+func Open(path string) (DB, error) {
+	isCDB, err := IsCDB(path)
+	if err != nil {
+		return nil, err
+	}
+	if !isCDB {
+		u, err := Load(path)
+		if err != nil {
+			return nil, err
+		}
+		return u, CheckSecrets(path, u)
+	}
+	readable, err := worldReadable(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := cdb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	version, err := cdbVersion(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &cdbDB{path: path, db: db, version: version, worldReadable: readable}, nil
+}
+
+// cdbVersion returns the version of the cdb database db, if this package
+// can read it.
+//
+func cdbVersion(db *cdb.CDB) (int, error) {
+	buf, err := db.Get([]byte(versionKey))
+	if err != nil {
+		// not %w: a missing record must not look like a missing account
+		return 0, fmt.Errorf("%w: no version: %v", ErrInvalid, err)
+	}
+	version, err := strconv.Atoi(string(buf))
+	if err != nil {
+		return 0, fmt.Errorf("%w: version: %v", ErrInvalid, err)
+	}
+	return version, checkVersion(version)
+}
+
+// IsCDB reports whether path holds a cdb database rather than JSON.
+// A name ending in ".cdb" or ".json" decides it. Otherwise a file starting
+// with "{", or an empty one, is JSON, and anything else is cdb.
+//
+func IsCDB(path string) (bool, error) {
+	switch filepath.Ext(path) {
+	case ".cdb":
+		return true, nil
+	case ".json":
+		return false, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	buf = bytes.TrimLeft(buf[:n], " \t\r\n")
+	return len(buf) > 0 && buf[0] != '{', nil
+}
+
+// cdbDB is an open cdb database.
+//
+type cdbDB struct {
+	path          string
+	db            *cdb.CDB
+	version       int
+	worldReadable bool
+}
+
+func (c *cdbDB) Lookup(owner, domain string) (*Account, error) {
+	buf, err := c.db.Get(cdbKey(owner, domain))
+	if err != nil {
+		return nil, err
+	}
+	account, err := decodeAccount(buf, c.version)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s@%s: %w: %v", c.path, owner, domain, ErrInvalid, err)
+	}
+	if c.worldReadable && account.Password != "" {
+		return nil, fmt.Errorf("%s: %w (%s@%s); chmod o-r it, or use password_file, password_env or password_command", c.path, ErrWorldReadable, owner, domain)
+	}
+	if err := account.ResolvePassword(); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func (c *cdbDB) Close() error {
+	return c.db.Close()
+}
+
+// loadCDB reads a whole cdb database, upgrading it to the current version
+// and checking it as decode does.
+//
+func loadCDB(path string) (*Users, error) {
+	db, err := cdb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	version, err := cdbVersion(db)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	users := Users{Version: Version}
+	var problems []string
+	err = db.ForEach(func(key, value []byte) error {
+		if string(key) == versionKey {
+			return nil
+		}
+		account, err := decodeAccount(value, version)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", key, err))
+			return nil
+		}
+		users.Accounts = append(users.Accounts, *account)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	problems = append(problems, users.problems()...)
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%s: %w", path, invalid(problems))
+	}
+	return &users, nil
+}
+
+// SaveCDB writes u to path as a cdb database. The new database replaces
+// any old one in a single step, so deliveries reading it never see a
+// partly written file. It keeps the owner, group and mode of the old one.
+//
+func (u *Users) SaveCDB(path string) error {
+	w, err := cdb.Create(path, 0600)
+	if err != nil {
+		return err
+	}
+	if err = keepOwner(w, path); err != nil {
+		w.Abort()
+		return err
+	}
+	if err = w.Add([]byte(versionKey), []byte(strconv.Itoa(u.Version))); err != nil {
+		w.Abort()
+		return err
+	}
+	for _, account := range u.Accounts {
+		buf, err := json.Marshal(account)
+		if err == nil {
+			err = w.Add(cdbKey(account.Owner, account.Domain), buf)
+		}
+		if err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	return w.Close()
+}
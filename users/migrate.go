@@ -0,0 +1,131 @@
+package users
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/wavemechanics/etype"
+)
+
+// Version is the version of the user database format written by this
+// package. Version 2 declares the account fields added since version 1,
+// from fallbacks to public_key, and requires owners to be lower case.
+//
+const Version = 2
+
+const ErrVersion = etype.Sentinel("unknown user database version")
+
+// migrations upgrade an account, decoded as a JSON object, from one
+// version of the format to the next: migrations[v] upgrades version v to
+// v+1. They run before the account is decoded, so they can rename or
+// reshape fields that Account no longer has.
+//
+var migrations = map[int]func(account map[string]json.RawMessage) error{
+	1: migrate1,
+}
+
+// migrate1 upgrades a version 1 account. Version 1 ignored unknown fields,
+// so the fields added since then were already accepted, but an owner with
+// upper case letters could never match a localpart, which is always lower
+// cased.
+//
+func migrate1(account map[string]json.RawMessage) error {
+	raw, ok := account["owner"]
+	if !ok {
+		return nil
+	}
+	var owner string
+	if err := json.Unmarshal(raw, &owner); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(strings.ToLower(owner))
+	if err != nil {
+		return err
+	}
+	account["owner"] = raw
+	return nil
+}
+
+// checkVersion returns an error wrapping ErrVersion if this package can't
+// read a database of the given version.
+//
+func checkVersion(version int) error {
+	if version == Version {
+		return nil
+	}
+	if _, ok := migrations[version]; !ok {
+		return fmt.Errorf("%w %d; this qdeliver reads versions 1 to %d", ErrVersion, version, Version)
+	}
+	return nil
+}
+
+// decodeAccount decodes an account written in the given version of the
+// format, after upgrading it to the current one. Unknown fields are
+// errors.
+//
+func decodeAccount(buf []byte, version int) (*Account, error) {
+	if version != Version {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(buf, &fields); err != nil {
+			return nil, err
+		}
+		for v := version; v < Version; v++ {
+			if err := migrations[v](fields); err != nil {
+				return nil, fmt.Errorf("upgrading from version %d: %v", v, err)
+			}
+		}
+		var err error
+		if buf, err = json.Marshal(fields); err != nil {
+			return nil, err
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	var account Account
+	if err := dec.Decode(&account); err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// decode reads a JSON user database, upgrading it to the current version.
+// Every account is decoded, and all the problems found, including those
+// reported by Validate, are returned together in one error wrapping
+// ErrInvalid.
+//
+func decode(buf []byte) (*Users, error) {
+	var file struct {
+		Version  *int              `json:"version"`
+		Accounts []json.RawMessage `json:"accounts"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, err
+	}
+	if file.Version == nil {
+		return nil, fmt.Errorf("%w: no version", ErrInvalid)
+	}
+	if err := checkVersion(*file.Version); err != nil {
+		return nil, err
+	}
+
+	users := Users{Version: Version}
+	var problems []string
+	for i, raw := range file.Accounts {
+		account, err := decodeAccount(raw, *file.Version)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("account %d: %v", i+1, err))
+			continue
+		}
+		users.Accounts = append(users.Accounts, *account)
+	}
+	problems = append(problems, users.problems()...)
+	if len(problems) > 0 {
+		return nil, invalid(problems)
+	}
+	return &users, nil
+}
@@ -0,0 +1,153 @@
+package users
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/wavemechanics/etype"
+)
+
+const (
+	ErrPassword      = etype.Sentinel("cannot get password")
+	ErrWorldReadable = etype.Sentinel("world-readable user database holds passwords")
+)
+
+// defaultPasswordTimeout limits how long password_command may run for an
+// account without a timeout of its own.
+//
+const defaultPasswordTimeout = 10 * time.Second
+
+// passwordSources returns how many of the ways of giving a password are
+// used by a.
+//
+func (a *Account) passwordSources() int {
+	n := 0
+	for _, s := range []string{a.Password, a.PasswordFile, a.PasswordEnv, a.PasswordCommand} {
+		if s != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// ResolvePassword sets a.Password from a.PasswordFile, a.PasswordEnv or
+// a.PasswordCommand, whichever is set. A trailing newline is removed.
+// An account may give its password only one way, and errors wrap
+// ErrPassword.
+//
+func (a *Account) ResolvePassword() error {
+	if a.passwordSources() > 1 {
+		return fmt.Errorf("%s@%s: %w: more than one of password, password_file, password_env and password_command", a.Owner, a.Domain, ErrPassword)
+	}
+
+	var password string
+	switch {
+	case a.PasswordFile != "":
+		buf, err := ioutil.ReadFile(a.PasswordFile)
+		if err != nil {
+			// not %w: a missing file must not look like a missing account
+			return fmt.Errorf("%s@%s: %w: %v", a.Owner, a.Domain, ErrPassword, err)
+		}
+		password = string(buf)
+	case a.PasswordEnv != "":
+		value, ok := os.LookupEnv(a.PasswordEnv)
+		if !ok {
+			return fmt.Errorf("%s@%s: %w: $%s is not set", a.Owner, a.Domain, ErrPassword, a.PasswordEnv)
+		}
+		password = value
+	case a.PasswordCommand != "":
+		out, err := a.runPasswordCommand()
+		if err != nil {
+			return fmt.Errorf("%s@%s: %w: password_command: %v", a.Owner, a.Domain, ErrPassword, err)
+		}
+		password = out
+	default:
+		return nil
+	}
+
+	a.Password = strings.TrimSuffix(strings.TrimSuffix(password, "\n"), "\r")
+	return nil
+}
+
+// runPasswordCommand runs a.PasswordCommand and returns what it prints.
+// Accounts are looked up before delivery starts, so the command is
+// limited to the account's timeout, and on timeout it is killed along
+// with anything it started, which could otherwise hold its output open.
+//
+func (a *Account) runPasswordCommand() (string, error) {
+	timeout := defaultPasswordTimeout
+	if a.Timeout > 0 {
+		timeout = time.Duration(a.Timeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", a.PasswordCommand)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+	err := cmd.Wait()
+	close(done)
+
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("timed out after %v", timeout)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+// CheckSecrets returns an error wrapping ErrWorldReadable if anyone can
+// read the user database at path, and any of the accounts in u has its
+// password in the database rather than somewhere else.
+//
+func CheckSecrets(path string, u *Users) error {
+	readable, err := worldReadable(path)
+	if err != nil || !readable {
+		return err
+	}
+	var owners []string
+	for _, account := range u.Accounts {
+		if account.Password != "" {
+			owners = append(owners, account.Owner+"@"+account.Domain)
+		}
+	}
+	if len(owners) > 0 {
+		return fmt.Errorf("%s: %w (%s); chmod o-r it, or use password_file, password_env or password_command", path, ErrWorldReadable, strings.Join(owners, ", "))
+	}
+	return nil
+}
+
+// worldReadable reports whether anyone can read the file at path.
+//
+func worldReadable(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	return info.Mode().Perm()&0004 != 0, nil
+}
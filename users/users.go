@@ -2,8 +2,15 @@ package users
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/wavemechanics/qdeliver/store/layout"
 )
 
 type Users struct {
@@ -11,44 +18,257 @@ type Users struct {
 	Accounts []Account `json:"accounts"`
 }
 
+// An Account says where the address files for owner@domain are kept.
+// Fallbacks are URLs of copies of them, which are read in order when URL
+// can't be reached. If Replicate is set, files written to URL are also
+// written to the fallbacks. If PublicKey, a base64 ed25519 public key, is
+// set, address files must be signed with its private key.
+//
+// Instead of Password, the password can be read from a file, taken from
+// an environment variable or printed by a shell command, when the account
+// is looked up; see ResolvePassword.
+//
 type Account struct {
-	Owner    string `json:"owner"`
-	Domain   string `json:"domain"`
-	URL      string `json:"url"`
-	Login    string `json:"login"`
-	Password string `json:"password"`
-	Notify   bool   `json:"notify"`
+	Owner           string   `json:"owner"`
+	Domain          string   `json:"domain"`
+	URL             string   `json:"url"`
+	Fallbacks       []string `json:"fallbacks,omitempty"`
+	Replicate       bool     `json:"replicate,omitempty"`
+	Login           string   `json:"login"`
+	Password        string   `json:"password,omitempty"`
+	PasswordFile    string   `json:"password_file,omitempty"`
+	PasswordEnv     string   `json:"password_env,omitempty"`
+	PasswordCommand string   `json:"password_command,omitempty"`
+	Notify          bool     `json:"notify"`
+	Timeout         Duration `json:"timeout,omitempty"`
+	Retry           *Retry   `json:"retry,omitempty"`
+	Auth            *Auth    `json:"auth,omitempty"`
+	TLS             *TLS     `json:"tls,omitempty"`
+	Layout          *Layout  `json:"layout,omitempty"`
+	PublicKey       string   `json:"public_key,omitempty"`
+}
+
+// Layout says how keys are mapped to file names in an account's storage.
+// Extension replaces the default ".txt", and may be empty for no extension.
+// If OwnerDir is set, files are kept in a subdirectory named after the
+// owner. Shard is the number of directory levels named after the first
+// characters of each key.
+//
+type Layout struct {
+	Extension *string `json:"extension,omitempty"`
+	OwnerDir  bool    `json:"owner_dir,omitempty"`
+	Shard     int     `json:"shard,omitempty"`
+}
+
+// FileLayout returns the layout set by the account's Layout, or
+// layout.Default.
+//
+func (a *Account) FileLayout() (layout.Layout, error) {
+	l := layout.Default
+	settings := a.Layout
+	if settings == nil {
+		return l, nil
+	}
+	if settings.Extension != nil {
+		l.Ext = *settings.Extension
+		if l.Ext != "" && (!strings.HasPrefix(l.Ext, ".") || strings.ContainsAny(l.Ext, "/\\")) {
+			return layout.Layout{}, fmt.Errorf("layout: extension %q must start with a dot", l.Ext)
+		}
+	}
+	if settings.OwnerDir {
+		l.Dir = a.Owner
+	}
+	if settings.Shard < 0 || settings.Shard > layout.MaxShard {
+		return layout.Layout{}, fmt.Errorf("layout: shard %d is not between 0 and %d", settings.Shard, layout.MaxShard)
+	}
+	l.Shard = settings.Shard
+	return l, nil
+}
+
+// Auth says how to authenticate to a webdav server.
+// Mode is "basic" (the default) or "digest", which use the account's login
+// and password, "bearer", which sends the password as a bearer token, or
+// "cert", which only uses a client certificate. Cert and Key name PEM
+// files holding a client certificate and its private key, which may be
+// used with any mode.
+//
+type Auth struct {
+	Mode string `json:"mode,omitempty"`
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+}
+
+// Retry says how storage requests that fail temporarily are retried.
+//
+type Retry struct {
+	Attempts   int      `json:"attempts"`
+	Backoff    Duration `json:"backoff,omitempty"`
+	MaxBackoff Duration `json:"max_backoff,omitempty"`
+}
+
+// TLS holds the settings for https connections to a webdav server.
+// CA names a PEM file of certificate authorities to trust instead of the
+// system's. Pin is the base64 SHA-256 hash of the server's public key
+// (SubjectPublicKeyInfo), optionally prefixed by "sha256/", and the
+// server's certificate chain must include a matching key. MinVersion is
+// the oldest TLS version allowed, such as "1.2".
+//
+type TLS struct {
+	CA         string `json:"ca,omitempty"`
+	Pin        string `json:"pin,omitempty"`
+	MinVersion string `json:"min_version,omitempty"`
 }
 
+// A Duration is a time.Duration written in JSON as a string such as "1m30s".
+//
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(buf []byte) error {
+	var s string
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// Load reads the whole user database at path, which may be JSON or cdb;
+// see IsCDB. A database written in an older version of the format is
+// upgraded to the current one. Unknown fields are errors, and so are the
+// mistakes Validate looks for.
+//
 func Load(path string) (*Users, error) {
-	f, err := os.Open(path)
+	isCDB, err := IsCDB(path)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	if isCDB {
+		return loadCDB(path)
+	}
 
-	dec := json.NewDecoder(f)
-	var users Users
-	if err = dec.Decode(&users); err != nil {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
 		return nil, err
 	}
-	return &users, nil
+	users, err := decode(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return users, nil
 }
 
+// Lookup returns a copy of the account for owner@domain, with its
+// password resolved.
+//
 func (u *Users) Lookup(owner, domain string) (*Account, error) {
 	for _, account := range u.Accounts {
 		if account.Owner == owner && account.Domain == domain {
+			if err := account.ResolvePassword(); err != nil {
+				return nil, err
+			}
 			return &account, nil
 		}
 	}
 	return nil, os.ErrNotExist
 }
 
+// Close does nothing; Users is a DB whose accounts are all in memory.
+//
+func (u *Users) Close() error {
+	return nil
+}
+
+// Save writes u to path, as a cdb database if path ends in ".cdb", or
+// otherwise as JSON. The new file replaces any old one in a single step,
+// and has its owner, group and mode; a file that didn't exist before can
+// only be read by its owner.
+//
 func (u *Users) Save(path string) error {
+	if filepath.Ext(path) == ".cdb" {
+		return u.SaveCDB(path)
+	}
+
 	buf, err := json.MarshalIndent(u, "", "    ")
 	if err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(path, buf, 0666)
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // if it wasn't renamed
+
+	if err = keepOwner(tmp, path); err == nil {
+		_, err = tmp.Write(buf)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// replacement is a new file that will replace an old one.
+//
+type replacement interface {
+	Chmod(mode os.FileMode) error
+	Chown(uid, gid int) error
+}
+
+// keepOwner gives f the owner, group and mode of the file at path, which
+// f will replace. The database is usually edited by root but read by the
+// user qmail delivers mail as, who must still be able to read it.
+// If path doesn't exist, only f's owner may read it.
+//
+func keepOwner(f replacement, path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return f.Chmod(0600)
+	}
+	if err != nil {
+		return err
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err = f.Chown(int(st.Uid), int(st.Gid)); err != nil {
+			return err
+		}
+	}
+	return f.Chmod(info.Mode().Perm())
+}
+
+// Lock takes an exclusive lock on the user database at path, waiting if
+// someone else has it, so that edits made at the same time aren't lost.
+// The lock is on path+".lock", since saving replaces path itself.
+// Calling the function returned releases it.
+//
+func Lock(path string) (unlock func(), err error) {
+	f, err := os.OpenFile(path+".lock", os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s.lock: %w", path, err)
+	}
+	return func() { f.Close() }, nil
 }
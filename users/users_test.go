@@ -1,13 +1,18 @@
 package users_test
 
 import (
+	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/wavemechanics/qdeliver/store/layout"
 	"github.com/wavemechanics/qdeliver/users"
 )
 
@@ -19,6 +24,8 @@ func TestLoad(t *testing.T) {
 		{"noexist", false},
 		{"bad-json.json", false},
 		{"users.json", true},
+		{"unknown-field.json", false},
+		{"unknown-version.json", false},
 	}
 
 	for _, test := range tests {
@@ -84,12 +91,12 @@ func TestSave(t *testing.T) {
 	}
 
 	udata = &users.Users{
-		Version: 1,
+		Version: users.Version,
 		Accounts: []users.Account{
 			{
 				Owner:    "owner",
 				Domain:   "domain",
-				URL:      "url",
+				URL:      "file:///url",
 				Login:    "login",
 				Password: "password",
 				Notify:   true,
@@ -97,10 +104,16 @@ func TestSave(t *testing.T) {
 			{
 				Owner:    "owner2",
 				Domain:   "domain2",
-				URL:      "url2",
+				URL:      "file:///url2",
 				Login:    "login2",
 				Password: "password2",
 				Notify:   true,
+				Timeout:  users.Duration(30 * time.Second),
+				Retry: &users.Retry{
+					Attempts:   3,
+					Backoff:    users.Duration(100 * time.Millisecond),
+					MaxBackoff: users.Duration(2 * time.Second),
+				},
 			},
 		},
 	}
@@ -125,4 +138,344 @@ func TestSave(t *testing.T) {
 	if !reflect.DeepEqual(udata, got) {
 		t.Fatalf("%v, want %v", udata, got)
 	}
+
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("saved with mode %v, %v, want 0600", info.Mode(), err)
+	}
+	infos, _ := ioutil.ReadDir(dir)
+	if len(infos) != 1 {
+		t.Fatalf("directory holds %d files, want 1", len(infos))
+	}
+
+	// saving again keeps the owner and mode of the file replaced
+	for _, name := range []string{"users.json", "users.cdb"} {
+		path := filepath.Join(dir, name)
+		if err = udata.Save(path); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Chmod(path, 0640); err != nil {
+			t.Fatal(err)
+		}
+		uid := os.Geteuid()
+		if uid == 0 {
+			uid = 1 // only root can give files away
+			if err = os.Chown(path, uid, -1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = udata.Save(path); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0640 {
+			t.Errorf("%s: saved again with mode %v, want 0640", name, info.Mode())
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != uid {
+			t.Errorf("%s: saved again with owner %d, want %d", name, st.Uid, uid)
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	var tests = []struct {
+		json string
+		ok   bool
+		d    time.Duration
+	}{
+		{`"10s"`, true, 10 * time.Second},
+		{`"1m30s"`, true, 90 * time.Second},
+		{`"250ms"`, true, 250 * time.Millisecond},
+		{`"10"`, false, 0},
+		{`10`, false, 0},
+	}
+
+	for _, test := range tests {
+		var d users.Duration
+		err := json.Unmarshal([]byte(test.json), &d)
+		if test.ok != (err == nil) {
+			t.Errorf("%s: %v, want ok=%v", test.json, err, test.ok)
+			continue
+		}
+		if time.Duration(d) != test.d {
+			t.Errorf("%s: %v, want %v", test.json, time.Duration(d), test.d)
+		}
+	}
+}
+
+func TestCDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestCDB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	u, err := users.Load(filepath.Join("testdata", "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "users.cdb")
+	if err = u.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := users.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, u) {
+		t.Fatalf("Load of cdb: %+v, want %+v", got, u)
+	}
+
+	// detected by contents when the name doesn't say
+	renamed := filepath.Join(dir, "users.db")
+	if err = os.Rename(path, renamed); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		path  string
+		isCDB bool
+	}{
+		{renamed, true},
+		{filepath.Join("testdata", "users.json"), false},
+	} {
+		if isCDB, err := users.IsCDB(test.path); err != nil || isCDB != test.isCDB {
+			t.Errorf("IsCDB(%q): %v, %v, want %v", test.path, isCDB, err, test.isCDB)
+		}
+	}
+
+	db, err := users.Open(renamed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	account, err := db.Lookup("foo", "example.com")
+	if err != nil || account.Login != "joe" {
+		t.Fatalf("Lookup: %+v, %v", account, err)
+	}
+	if _, err = db.Lookup("foo", "wrong.com"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Lookup of missing account: %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestResolvePassword(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestResolvePassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "password")
+	if err = ioutil.WriteFile(file, []byte("from file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("QDELIVER_TEST_PASSWORD", "from env")
+	defer os.Unsetenv("QDELIVER_TEST_PASSWORD")
+
+	var tests = []struct {
+		name     string
+		account  users.Account
+		password string
+		err      error
+	}{
+		{"inline", users.Account{Password: "inline"}, "inline", nil},
+		{"none", users.Account{}, "", nil},
+		{"file", users.Account{PasswordFile: file}, "from file", nil},
+		{"missing file", users.Account{PasswordFile: filepath.Join(dir, "missing")}, "", users.ErrPassword},
+		{"env", users.Account{PasswordEnv: "QDELIVER_TEST_PASSWORD"}, "from env", nil},
+		{"unset env", users.Account{PasswordEnv: "QDELIVER_TEST_UNSET"}, "", users.ErrPassword},
+		{"command", users.Account{PasswordCommand: "printf 'from command\\r\\n'"}, "from command", nil},
+		{"failing command", users.Account{PasswordCommand: "exit 1"}, "", users.ErrPassword},
+		{"two ways", users.Account{Password: "inline", PasswordEnv: "QDELIVER_TEST_PASSWORD"}, "", users.ErrPassword},
+	}
+	for _, test := range tests {
+		account := test.account
+		err := account.ResolvePassword()
+		if !errors.Is(err, test.err) || (err == nil) != (test.err == nil) {
+			t.Errorf("%s: %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s: %v would look like a missing account", test.name, err)
+		}
+		if err == nil && account.Password != test.password {
+			t.Errorf("%s: password %q, want %q", test.name, account.Password, test.password)
+		}
+	}
+}
+
+func TestPasswordTimeout(t *testing.T) {
+	// sleep keeps the output open after sh is killed
+	account := users.Account{
+		PasswordCommand: "sleep 5; echo late",
+		Timeout:         users.Duration(100 * time.Millisecond),
+	}
+	start := time.Now()
+	err := account.ResolvePassword()
+	if !errors.Is(err, users.ErrPassword) {
+		t.Fatalf("%v, want %v", err, users.ErrPassword)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("took %v with a timeout of 100ms", elapsed)
+	}
+}
+
+func TestCheckSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestCheckSecrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inline := &users.Users{Version: 1, Accounts: []users.Account{{Owner: "a", Domain: "example.com", URL: "file:///tmp", Password: "secret"}}}
+	external := &users.Users{Version: 1, Accounts: []users.Account{{Owner: "a", Domain: "example.com", URL: "file:///tmp", PasswordEnv: "PASSWORD"}}}
+
+	var tests = []struct {
+		name string
+		db   *users.Users
+		mode os.FileMode
+		err  error
+	}{
+		{"private", inline, 0600, nil},
+		{"group", inline, 0640, nil},
+		{"world", inline, 0644, users.ErrWorldReadable},
+		{"world, no passwords", external, 0644, nil},
+	}
+	for _, test := range tests {
+		for _, name := range []string{"users.json", "users.cdb"} {
+			path := filepath.Join(dir, name)
+			if err := test.db.Save(path); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(path, test.mode); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err := users.Open(path)
+			if err == nil {
+				_, err = db.Lookup("a", "example.com")
+				db.Close()
+			}
+			if errors.Is(err, users.ErrPassword) {
+				err = nil // $PASSWORD isn't set; not what is being tested
+			}
+			if !errors.Is(err, test.err) || (err == nil) != (test.err == nil) {
+				t.Errorf("%s: %s: %v, want %v", test.name, name, err, test.err)
+			}
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	good := users.Account{Owner: "a", Domain: "example.com", URL: "file:///tmp"}
+
+	var tests = []struct {
+		name  string
+		tweak func(a *users.Account)
+		ok    bool
+	}{
+		{"good", func(a *users.Account) {}, true},
+		{"no owner", func(a *users.Account) { a.Owner = "" }, false},
+		{"no domain", func(a *users.Account) { a.Domain = "" }, false},
+		{"upper case owner", func(a *users.Account) { a.Owner = "A" }, false},
+		{"owner with -", func(a *users.Account) { a.Owner = "a-b" }, false},
+		{"no url", func(a *users.Account) { a.URL = "" }, false},
+		{"one password", func(a *users.Account) { a.PasswordEnv = "PASSWORD" }, true},
+		{"two passwords", func(a *users.Account) { a.Password, a.PasswordEnv = "secret", "PASSWORD" }, false},
+	}
+	for _, test := range tests {
+		account := good
+		test.tweak(&account)
+		db := &users.Users{Version: 1, Accounts: []users.Account{account}}
+		err := db.Validate()
+		if (err == nil) != test.ok || err != nil && !errors.Is(err, users.ErrInvalid) {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+
+	db := &users.Users{Version: 1, Accounts: []users.Account{good, good}}
+	if err := db.Validate(); !errors.Is(err, users.ErrInvalid) {
+		t.Errorf("duplicate: %v, want %v", err, users.ErrInvalid)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMigrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	u, err := users.Load(filepath.Join("testdata", "v1.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Version != users.Version || len(u.Accounts) != 1 || u.Accounts[0].Owner != "foo" {
+		t.Fatalf("Load of version 1: %+v", u)
+	}
+
+	// a version 1 cdb is upgraded as each account is looked up
+	v1 := &users.Users{Version: 1, Accounts: []users.Account{{Owner: "foo", Domain: "example.com", URL: "http://some/place", Login: "joe"}}}
+	path := filepath.Join(dir, "users.cdb")
+	if err = v1.SaveCDB(path); err != nil {
+		t.Fatal(err)
+	}
+	db, err := users.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if account, err := db.Lookup("foo", "example.com"); err != nil || account.Login != "joe" {
+		t.Fatalf("Lookup in version 1 cdb: %+v, %v", account, err)
+	}
+
+	v3 := &users.Users{Version: users.Version + 1}
+	if err = v3.SaveCDB(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = users.Open(path); !errors.Is(err, users.ErrVersion) {
+		t.Fatalf("Open of version %d: %v, want %v", v3.Version, err, users.ErrVersion)
+	}
+	if _, err = users.Load(filepath.Join("testdata", "unknown-version.json")); !errors.Is(err, users.ErrVersion) {
+		t.Fatalf("Load of unknown version: %v, want %v", err, users.ErrVersion)
+	}
+
+	// every problem is reported at once
+	_, err = users.Load(filepath.Join("testdata", "invalid.json"))
+	if !errors.Is(err, users.ErrInvalid) {
+		t.Fatalf("Load of invalid database: %v, want %v", err, users.ErrInvalid)
+	}
+	for _, want := range []string{"has no scheme", "account 2: ", "needs both owner and domain", "more than one account"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Load of invalid database: %v, want %q", err, want)
+		}
+	}
+}
+
+func TestFileLayout(t *testing.T) {
+	none, conf, bad := "", ".conf", "conf"
+
+	var tests = []struct {
+		layout *users.Layout
+		want   layout.Layout
+		ok     bool
+	}{
+		{nil, layout.Default, true},
+		{&users.Layout{}, layout.Default, true},
+		{&users.Layout{Extension: &none}, layout.Layout{}, true},
+		{&users.Layout{Extension: &conf, OwnerDir: true, Shard: 2}, layout.Layout{Dir: "me", Shard: 2, Ext: ".conf"}, true},
+		{&users.Layout{Extension: &bad}, layout.Layout{}, false},
+		{&users.Layout{Shard: layout.MaxShard + 1}, layout.Layout{}, false},
+		{&users.Layout{Shard: -1}, layout.Layout{}, false},
+	}
+
+	for _, test := range tests {
+		l, err := (&users.Account{Owner: "me", Layout: test.layout}).FileLayout()
+		if test.ok != (err == nil) || l != test.want {
+			t.Errorf("%+v: %+v, %v, want %+v", test.layout, l, err, test.want)
+		}
+	}
 }
@@ -0,0 +1,87 @@
+package users
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/wavemechanics/etype"
+)
+
+const ErrInvalid = etype.Sentinel("invalid user database")
+
+// Validate checks u for mistakes that would stop an account being found
+// or used: a missing owner, domain or url, a url or fallback that isn't
+// an absolute URL, an owner that could never match a localpart, more than
+// one account for an owner and domain, and more than one way of giving a
+// password.
+// All the mistakes found are reported in one error wrapping ErrInvalid.
+//
+func (u *Users) Validate() error {
+	if problems := u.problems(); len(problems) > 0 {
+		return invalid(problems)
+	}
+	return nil
+}
+
+// invalid returns an error wrapping ErrInvalid that lists problems.
+//
+func invalid(problems []string) error {
+	return fmt.Errorf("%w: %s", ErrInvalid, strings.Join(problems, "; "))
+}
+
+// problems returns the mistakes Validate looks for, one per string.
+//
+func (u *Users) problems() []string {
+	var problems []string
+	seen := make(map[string]bool)
+	for i, a := range u.Accounts {
+		where := fmt.Sprintf("account %d", i+1)
+		if a.Owner != "" || a.Domain != "" {
+			where = a.Owner + "@" + a.Domain
+		}
+		problem := func(format string, args ...interface{}) {
+			problems = append(problems, where+": "+fmt.Sprintf(format, args...))
+		}
+
+		if a.Owner == "" || a.Domain == "" {
+			problem("needs both owner and domain")
+		}
+		if a.Owner != strings.ToLower(a.Owner) || strings.Contains(a.Owner, "-") {
+			problem("owner must be lower case, without %q", "-")
+		}
+		if a.URL == "" {
+			problem("no url")
+		} else if err := checkURL(a.URL); err != nil {
+			problem("url: %v", err)
+		}
+		for _, fallback := range a.Fallbacks {
+			if err := checkURL(fallback); err != nil {
+				problem("fallback: %v", err)
+			}
+		}
+		if a.passwordSources() > 1 {
+			problem("more than one of password, password_file, password_env and password_command")
+		}
+		key := a.Owner + "@" + a.Domain
+		if seen[key] {
+			problem("more than one account")
+		}
+		seen[key] = true
+	}
+	return problems
+}
+
+// checkURL returns an error if s isn't an absolute URL. Whether its
+// scheme is one of the storage backends is left to store.Open.
+//
+func checkURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" {
+		return fmt.Errorf("%q has no scheme", s)
+	}
+	return nil
+}